@@ -4,11 +4,15 @@ import (
 	"crypto/sha1"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -16,11 +20,26 @@ import (
 // archIndex is a map of architecture identifiers (e.g., "x86_64") to
 // parsed repodata.
 type archIndex struct {
-	archs map[string]*RepoData
+	archs  map[string]*RepoData
+	staged map[string]*RepoData // Stage data (<arch>-stagedata), if any
+	config *loadConfig
+
+	// Staged packages that differ from repodata, by arch (see initStaged)
+	stagedUpdates map[string][]stagedUpdate
 
 	// Index listing
-	names []string
+	names []string // Arches with repodata
+	all   []string // Arches with repodata or stage data
 	etag  string
+
+	loadedAt     time.Time
+	loadDuration time.Duration
+
+	cache responseCache // Encoded responses built from this index (see replyCached)
+
+	errors []loadError      // Errors from the load
+	kept   map[archKey]bool // Data kept from a previous load due to errors
+	pool   poolStats        // Strings and packages interned by the load
 }
 
 func (a *archIndex) Arch(name string) *RepoData {
@@ -30,6 +49,34 @@ func (a *archIndex) Arch(name string) *RepoData {
 	return a.archs[name]
 }
 
+// Staged returns the stage data for the named arch.
+func (a *archIndex) Staged(name string) *RepoData {
+	if a == nil {
+		return nil
+	}
+	return a.staged[name]
+}
+
+// StagedUpdates returns the staged packages for the named arch that are not yet in its
+// repodata.
+func (a *archIndex) StagedUpdates(name string) []stagedUpdate {
+	if a == nil {
+		return nil
+	}
+	return a.stagedUpdates[name]
+}
+
+// StagedPackage returns the staged version of a package, if it differs from the package. The
+// staged package must be from the same repository as p.
+func (a *archIndex) StagedPackage(arch string, p *packageData) *packageData {
+	for _, sp := range a.Staged(arch).Candidates(p.Name) {
+		if sp.Repository == p.Repository && sp.PackageVersion != p.PackageVersion {
+			return sp
+		}
+	}
+	return nil
+}
+
 func (a *archIndex) Index() []string {
 	if a == nil {
 		return nil
@@ -37,6 +84,15 @@ func (a *archIndex) Index() []string {
 	return a.names
 }
 
+// Archs returns the names of every arch with repodata or stage data. Unlike Index, this includes
+// arches that only have stage data.
+func (a *archIndex) Archs() []string {
+	if a == nil {
+		return nil
+	}
+	return a.all
+}
+
 func (a *archIndex) IndexETag() string {
 	if a == nil {
 		return ""
@@ -44,81 +100,372 @@ func (a *archIndex) IndexETag() string {
 	return a.etag
 }
 
+// loadPolicy determines how errors loading repodata are handled.
+type loadPolicy string
+
+const (
+	// loadStrict fails a reload if any repodata path or file cannot be loaded.
+	loadStrict loadPolicy = "strict"
+	// loadTolerant loads each arch independently. An arch with a file that cannot be loaded
+	// keeps the data from its last successful load, if any, and the error is recorded.
+	loadTolerant loadPolicy = "tolerant"
+)
+
+func (p *loadPolicy) Set(s string) error {
+	switch lp := loadPolicy(s); lp {
+	case loadStrict, loadTolerant:
+		*p = lp
+		return nil
+	}
+	return fmt.Errorf("invalid load policy %q: must be %s or %s", s, loadStrict, loadTolerant)
+}
+
+func (p *loadPolicy) String() string {
+	if p == nil {
+		return ""
+	}
+	return string(*p)
+}
+
+// loadConfig describes where repodata is loaded from and how it's loaded.
+type loadConfig struct {
+	// Paths is a list of files ending in -repodata or directories to be
+	// walked in search of -repodata files.
+	Paths []string
+
+	// TrustedKeys, if set, is a directory of trusted repository keys.
+	// Repodata not signed by a trusted key is rejected.
+	TrustedKeys string
+
+	// Policy determines how load errors are handled. Defaults to loadTolerant.
+	Policy loadPolicy
+
+	// Workers is the maximum number of repodata files to decode concurrently. If <= 0,
+	// GOMAXPROCS files are decoded concurrently.
+	Workers int
+
+	// Snapshot, if set, is the path of a snapshot of loaded repodata. The initial load uses
+	// files from the snapshot that haven't changed instead of decoding them (see
+	// writeSnapshot).
+	Snapshot string
+}
+
+// loadError is an error loading a repodata path or file. Arch is empty if the error is for a
+// path that could not be searched for repodata files.
+type loadError struct {
+	Path   string    `json:"path"`
+	Arch   string    `json:"arch,omitempty"`
+	Staged bool      `json:"staged,omitempty"`
+	Time   time.Time `json:"time"`
+	Error  string    `json:"error"`
+
+	err error
+}
+
+// archKey identifies the repodata or stage data for an arch.
+type archKey struct {
+	arch   string
+	staged bool
+}
+
+// repodataFile is a repodata or stagedata file to be loaded.
+type repodataFile struct {
+	archKey
+	path string
+	repo string
+}
+
 // loadArchIndices loads architecture-specific repodata into an
 // archIndex and returns the resulting index.
 //
-// files is a list of files ending in -repodata or directories to be
-// walked in search of -repodata files.
-//
 // A repodata file is of the form <arch>-repodata. So, x86_64-repodata
 // is for the arch x86_64.
-func loadArchIndices(files []string) (*archIndex, error) {
+//
+// Each arch's repodata and stage data are loaded separately. Under the tolerant policy, if any
+// of an arch's files (or a path that its files were previously found under) fails to load, the
+// arch keeps its data from prev, which may be nil. Errors are recorded in the returned index.
+// Under the strict policy, the first error is returned.
+//
+// If only is non-empty, only the named archs are loaded. Other archs keep their data (and
+// errors) from prev, unless prev has no data for them.
+func loadArchIndices(config *loadConfig, prev *archIndex, only ...string) (*archIndex, error) {
+	start := time.Now()
 	archs := &archIndex{
-		archs: map[string]*RepoData{},
-		names: []string{},
+		archs:  map[string]*RepoData{},
+		staged: map[string]*RepoData{},
+		config: config,
+		names:  []string{},
+		kept:   map[archKey]bool{},
 	}
+	strict := config.Policy == loadStrict
 
-	for _, rdpath := range files {
-		err := archs.loadPath(rdpath)
-		if err != nil {
-			return nil, err
+	files, errs := findRepodataFiles(config.Paths)
+	if strict && len(errs) > 0 {
+		return nil, errs[0].err
+	}
+
+	// Keep previous data for any arch with files under a path that couldn't be searched.
+	failed := map[archKey]bool{}
+	for _, lerr := range errs {
+		for _, key := range prev.keysUnder(lerr.Path) {
+			failed[key] = true
+		}
+	}
+
+	// reloading returns whether key must be loaded instead of being kept from prev.
+	reloading := func(key archKey) bool { return true }
+	if len(only) > 0 {
+		loading := map[string]bool{}
+		for _, arch := range only {
+			loading[arch] = true
+		}
+		reloading = func(key archKey) bool {
+			return loading[key.arch] || prev.data(key) == nil
+		}
+		for _, lerr := range prev.Errors() {
+			if lerr.Arch != "" && !loading[lerr.Arch] {
+				errs = append(errs, lerr)
+			}
+		}
+	}
+
+	var keys []archKey
+	groups := map[archKey][]repodataFile{}
+	for _, file := range files {
+		if _, ok := groups[file.archKey]; !ok {
+			keys = append(keys, file.archKey)
+		}
+		groups[file.archKey] = append(groups[file.archKey], file)
+	}
+
+	// Decode all files to be loaded concurrently, then merge each arch's files in the order
+	// they were found so that the result is the same as loading them one at a time.
+	var (
+		loading []archKey
+		load    []repodataFile
+		starts  []int // Index of each loading key's first file in load
+	)
+	for _, key := range keys {
+		if failed[key] {
+			continue
+		} else if !reloading(key) {
+			archs.set(key)[key.arch] = prev.data(key)
+			archs.kept[key] = prev.kept[key]
+			continue
+		}
+		loading = append(loading, key)
+		starts = append(starts, len(load))
+		load = append(load, groups[key]...)
+	}
+
+	var snap *snapshot
+	if initial := prev == nil || prev.loadedAt.IsZero(); initial && config.Snapshot != "" {
+		var err error
+		snap, err = readSnapshot(config.Snapshot)
+		if err != nil && !os.IsNotExist(err) {
+			glog.Warningf("unable to read snapshot: %v", err)
+		}
+	}
+
+	pool := newPackagePool()
+	decoded, decodeErrs := decodeRepodataFiles(config, snap, pool, load)
+	loaded := make([]*RepoData, len(loading))
+	loadErrs := make([]*loadError, len(loading))
+	parallel(config.Workers, len(loading), func(i int) {
+		first, last := starts[i], starts[i]+len(groups[loading[i]])
+		loaded[i], loadErrs[i] = mergeRepoData(load[first:last], decoded[first:last], decodeErrs[first:last])
+	})
+
+	for i, key := range loading {
+		if lerr := loadErrs[i]; lerr != nil {
+			if strict {
+				return nil, lerr.err
+			}
+			errs = append(errs, *lerr)
+			failed[key] = true
+			continue
+		}
+		archs.set(key)[key.arch] = loaded[i]
+	}
+
+	for key := range failed {
+		rd := prev.data(key)
+		if rd == nil {
+			continue
 		}
+		glog.Warningf("keeping previously loaded %s", key)
+		archs.set(key)[key.arch] = rd
+		archs.kept[key] = true
 	}
 
-	return archs, archs.init()
+	// A load that leaves no repodata at all is a failure, even if errors are tolerated, so that an
+	// initial load where every file failed isn't served (or reported ready) as empty data.
+	if len(archs.archs) == 0 {
+		if len(errs) > 0 {
+			return nil, fmt.Errorf("no repodata loaded: %w", errs[0].err)
+		}
+		return nil, errors.New("no repodata found")
+	}
+
+	archs.errors = errs
+	archs.pool = pool.Stats()
+	if err := archs.init(); err != nil {
+		return nil, err
+	}
+	archs.loadedAt = time.Now().UTC()
+	archs.loadDuration = time.Since(start)
+	return archs, nil
 }
 
-func (a *archIndex) loadPath(path string) error {
-	fi, err := os.Stat(path)
-	if err != nil {
-		glog.Warningf("ignoring repodata path: stat failed: %v", err)
+func (k archKey) String() string {
+	if k.staged {
+		return k.arch + "-stagedata"
+	}
+	return k.arch + "-repodata"
+}
+
+func (a *archIndex) set(key archKey) map[string]*RepoData {
+	if key.staged {
+		return a.staged
+	}
+	return a.archs
+}
+
+// data returns the repodata or stage data for key.
+func (a *archIndex) data(key archKey) *RepoData {
+	if key.staged {
+		return a.Staged(key.arch)
+	}
+	return a.Arch(key.arch)
+}
+
+// keysUnder returns the keys of all repodata and stage data with files loaded from under path.
+func (a *archIndex) keysUnder(path string) []archKey {
+	if a == nil {
+		return nil
+	}
+	path = absPath(path)
+	prefix := path + string(filepath.Separator)
+
+	var keys []archKey
+	for _, staged := range []bool{false, true} {
+		key := archKey{staged: staged}
+		for arch, rd := range a.set(key) {
+			for _, src := range rd.Sources() {
+				if src.Path == "" {
+					continue
+				}
+				if p := absPath(src.Path); p == path || strings.HasPrefix(p, prefix) {
+					key.arch = arch
+					keys = append(keys, key)
+					break
+				}
+			}
+		}
+	}
+	return keys
+}
+
+// absPath returns path as a clean, absolute path, so that paths given in different forms can be
+// compared. If it can't be made absolute, it's only cleaned.
+func absPath(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return filepath.Clean(path)
+}
+
+// Errors returns the errors that occurred while loading the index.
+func (a *archIndex) Errors() []loadError {
+	if a == nil {
 		return nil
 	}
+	return a.errors
+}
+
+// Kept returns whether the named arch's repodata or stage data was kept from a previous load
+// because it could not be loaded.
+func (a *archIndex) Kept(name string) bool {
+	if a == nil {
+		return false
+	}
+	return a.kept[archKey{arch: name}] || a.kept[archKey{arch: name, staged: true}]
+}
+
+func newLoadError(path string, key archKey, err error) *loadError {
+	glog.Warningf("repodata load error: %v", err)
+	return &loadError{
+		Path:   path,
+		Arch:   key.arch,
+		Staged: key.staged,
+		Time:   time.Now().UTC(),
+		Error:  err.Error(),
+		err:    err,
+	}
+}
+
+// findRepodataFiles returns all repodata and stagedata files found in paths, in the order
+// they're found. Paths that cannot be searched are returned as errors.
+func findRepodataFiles(paths []string) (files []repodataFile, errs []loadError) {
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			errs = append(errs, *newLoadError(path, archKey{}, err))
+			continue
+		}
+
+		if !fi.IsDir() {
+			file, err := newRepodataFile(path, "")
+			if err != nil {
+				errs = append(errs, *newLoadError(path, archKey{}, err))
+				continue
+			}
+			files = append(files, file)
+			continue
+		}
 
-	if fi.IsDir() {
 		glog.V(1).Infof("walking %s for repodata files", path)
-		return a.loadDir(path)
+		found, derrs := findRepodataDir(path)
+		files = append(files, found...)
+		errs = append(errs, derrs...)
 	}
-	return a.loadFile(path, "")
+	return files, errs
 }
 
-func (a *archIndex) loadDir(searchRoot string) error {
+func findRepodataDir(searchRoot string) (files []repodataFile, errs []loadError) {
 	searchRoot, err := filepath.Abs(searchRoot)
 	if err != nil {
-		return err
+		return nil, []loadError{*newLoadError(searchRoot, archKey{}, err)}
 	}
 
-	// Collect a list of -repodata files and load them.
-	var files []string
-	err = filepath.Walk(searchRoot, func(path string, wfi os.FileInfo, err error) error {
+	// Collect a list of -repodata and -stagedata files.
+	filepath.Walk(searchRoot, func(path string, wfi os.FileInfo, err error) error {
+		if err != nil {
+			errs = append(errs, *newLoadError(path, archKey{}, err))
+			if wfi != nil && wfi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
 		if wfi.IsDir() {
 			glog.V(2).Infof("walking %s for repodata files", path)
-		} else if strings.HasSuffix(path, "-repodata") {
-			files = append(files, path)
+		} else if _, _, ok := splitRepodataPath(path); ok {
+			file, _ := newRepodataFile(path, repositoryFromFileSearchRoot(searchRoot, path))
+			files = append(files, file)
 		}
 		// TODO: Follow symlinks?
 		return nil
 	})
-	if err != nil {
-		return err
-	}
-	for _, path := range files {
-		repo := repositoryFromFileSearchRoot(searchRoot, path)
-		if err = a.loadFile(path, repo); err != nil {
-			return err
-		}
-	}
-	return nil
+	return files, errs
 }
 
-func (a *archIndex) loadFile(path, repo string) error {
-	glog.Infof("loading %s", path)
-
-	if !strings.HasSuffix(path, "-repodata") {
-		return &os.PathError{
+func newRepodataFile(path, repo string) (repodataFile, error) {
+	arch, staged, ok := splitRepodataPath(path)
+	if !ok {
+		return repodataFile{}, &os.PathError{
 			Path: path,
 			Op:   "read",
-			Err:  errors.New("repodata files must end in -repodata"),
+			Err:  errors.New("repodata files must end in -repodata or -stagedata"),
 		}
 	}
 
@@ -132,25 +479,103 @@ func (a *archIndex) loadFile(path, repo string) error {
 		}
 	}
 
-	arch := filepath.Base(strings.TrimSuffix(path, "-repodata"))
-	rd := a.archs[arch]
-	if rd == nil {
-		rd = NewRepoData()
-		a.archs[arch] = rd
+	return repodataFile{
+		archKey: archKey{arch: arch, staged: staged},
+		path:    path,
+		repo:    repo,
+	}, nil
+}
+
+// decodeRepodataFiles decodes files concurrently, using up to config.Workers goroutines, and
+// interns their packages in pool. Files that are unchanged in snap, which may be nil, are taken
+// from snap instead. Results and errors are in the same order as files.
+func decodeRepodataFiles(config *loadConfig, snap *snapshot, pool *packagePool, files []repodataFile) ([]*decodedRepo, []*loadError) {
+	decoded := make([]*decodedRepo, len(files))
+	errs := make([]*loadError, len(files))
+	parallel(config.Workers, len(files), func(i int) {
+		file := files[i]
+		if dr := snap.lookup(file, config.TrustedKeys, pool); dr != nil {
+			glog.Infof("loading %s from snapshot", file.path)
+			decoded[i] = dr
+			return
+		}
+
+		glog.Infof("loading %s", file.path)
+		dr, err := decodeRepoFile(file.path, file.repo, config.TrustedKeys, pool, config.Snapshot != "")
+		if err != nil {
+			errs[i] = newLoadError(file.path, file.archKey, &os.PathError{Path: file.path, Err: err, Op: "load"})
+			return
+		}
+		decoded[i] = dr
+	})
+	return decoded, errs
+}
+
+// mergeRepoData merges decoded files, in order, into a new RepoData and builds its indices. If
+// any file failed to decode, the first error is returned.
+func mergeRepoData(files []repodataFile, decoded []*decodedRepo, errs []*loadError) (*RepoData, *loadError) {
+	for _, lerr := range errs {
+		if lerr != nil {
+			return nil, lerr
+		}
 	}
 
-	packages := len(rd.Index())
-	err := rd.LoadRepo(path, repo)
-	if err != nil {
-		return &os.PathError{Path: path, Err: err, Op: "load"}
+	rd := NewRepoData()
+	for i, file := range files {
+		packages := len(rd.Index())
+		if err := rd.merge(decoded[i]); err != nil {
+			return nil, newLoadError(file.path, file.archKey, &os.PathError{Path: file.path, Err: err, Op: "load"})
+		}
+		packages = len(rd.Index()) - packages
+
+		glog.V(1).Infof("loaded %s repo=%s new_packages=%d",
+			file.path, file.repo, packages)
 	}
+	rd.buildIndices()
+	return rd, nil
+}
 
-	packages = len(rd.Index()) - packages
+// parallel calls fn for each i in [0, n), using up to workers goroutines. If workers <= 0,
+// GOMAXPROCS goroutines are used. It returns once all calls to fn have returned.
+func parallel(workers, n int, fn func(i int)) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
 
-	glog.V(1).Infof("loaded %s repo=%s new_packages=%d",
-		path, repo, packages)
+	var (
+		wg   sync.WaitGroup
+		next = make(chan int)
+	)
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
 
-	return nil
+// splitRepodataPath returns the arch of a repodata or stagedata file and whether it's
+// stagedata. If path is neither, ok is false.
+func splitRepodataPath(path string) (arch string, staged, ok bool) {
+	base := filepath.Base(path)
+	switch {
+	case strings.HasSuffix(base, "-repodata"):
+		return strings.TrimSuffix(base, "-repodata"), false, true
+	case strings.HasSuffix(base, "-stagedata"):
+		return strings.TrimSuffix(base, "-stagedata"), true, true
+	}
+	return "", false, false
 }
 
 func repositoryFromFileSearchRoot(searchRoot, path string) string {
@@ -218,12 +643,29 @@ func repositoryFromPathList(path string) (repo string, ok bool) {
 	return strings.Join(list, "/"), true
 }
 
+// computeETag returns an ETag for the index. It covers the arch names and the ETags of every
+// arch's repodata and stage data, so it changes whenever any of them do.
 func (a *archIndex) computeETag() string {
 	h := sha1.New()
+	writeString := func(s string) {
+		binary.Write(h, binary.LittleEndian, int64(len(s)))
+		io.WriteString(h, s)
+	}
 	binary.Write(h, binary.LittleEndian, int64(len(a.names)))
 	for _, name := range a.names {
-		binary.Write(h, binary.LittleEndian, int64(len(name)))
-		io.WriteString(h, name)
+		writeString(name)
+		writeString(a.archs[name].ETag())
+	}
+
+	staged := make([]string, 0, len(a.staged))
+	for name := range a.staged {
+		staged = append(staged, name)
+	}
+	sort.Strings(staged)
+	binary.Write(h, binary.LittleEndian, int64(len(staged)))
+	for _, name := range staged {
+		writeString(name)
+		writeString(a.staged[name].ETag())
 	}
 	sum := h.Sum(make([]byte, 0, h.Size()))
 	return `W/"` + etagEncoding.EncodeToString(sum) + `"`
@@ -236,7 +678,49 @@ func (a *archIndex) init() error {
 	}
 	sort.Strings(names)
 
+	all := append([]string(nil), names...)
+	for k := range a.staged {
+		if a.archs[k] == nil {
+			all = append(all, k)
+		}
+	}
+	sort.Strings(all)
+
+	a.initStaged()
+
 	a.names = names
+	a.all = all
 	a.etag = a.computeETag()
 	return nil
 }
+
+// stagedUpdate is a staged package and the package it will replace, if any.
+type stagedUpdate struct {
+	Package *packageData
+	Current *packageData // Nil if the package is new
+}
+
+// initStaged finds staged packages that differ from the repodata for each arch.
+func (a *archIndex) initStaged() {
+	a.stagedUpdates = map[string][]stagedUpdate{}
+	for arch, staged := range a.staged {
+		rd := a.archs[arch]
+		var updates []stagedUpdate
+		for _, p := range staged.Index() {
+		candidates:
+			for _, sp := range staged.Candidates(p.Name) {
+				var current *packageData
+				for _, c := range rd.Candidates(sp.Name) {
+					if c.Repository != sp.Repository {
+						continue
+					} else if c.PackageVersion == sp.PackageVersion {
+						continue candidates
+					}
+					current = c
+				}
+				updates = append(updates, stagedUpdate{Package: sp, Current: current})
+			}
+		}
+		a.stagedUpdates[arch] = updates
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"howett.net/plist"
+)
+
+// writeTestRepodata writes a gzipped repodata file containing an index of the given pkgvers.
+func writeTestRepodata(t *testing.T, path string, pkgvers ...string) {
+	t.Helper()
+	index := map[string]map[string]interface{}{}
+	for _, pkgver := range pkgvers {
+		name, _, _, err := ParseVersionedName(pkgver)
+		if err != nil {
+			t.Fatalf("bad pkgver %q: %v", pkgver, err)
+		}
+		index[name] = map[string]interface{}{"pkgver": pkgver}
+	}
+	writeTestIndex(t, path, index)
+}
+
+// writeTestIndex writes a gzipped repodata file containing index, a map of package names to
+// their index.plist entries.
+func writeTestIndex(t *testing.T, path string, index map[string]map[string]interface{}) {
+	t.Helper()
+	p, err := plist.Marshal(index, plist.XMLFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	if err := tw.WriteHeader(&tar.Header{Name: repoIndexFile, Mode: 0644, Size: int64(len(p))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadArchIndicesTolerant(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xq-api-load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestRepodata(t, filepath.Join(dir, "x86_64-repodata"), "bash-5.0_1", "zlib-1.2.11_3")
+	writeTestRepodata(t, filepath.Join(dir, "nonfree", "x86_64-repodata"), "unrar-6.0.3_1")
+	writeTestRepodata(t, filepath.Join(dir, "aarch64-repodata"), "bash-5.0_1")
+
+	config := &loadConfig{Paths: []string{dir}, Policy: loadTolerant}
+	prev, err := loadArchIndices(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(prev.Arch("x86_64").Index()); got != 3 {
+		t.Fatalf("loaded %d x86_64 packages; want 3", got)
+	}
+
+	// Corrupt one x86_64 file and update aarch64.
+	nonfree := filepath.Join(dir, "nonfree", "x86_64-repodata")
+	if err := ioutil.WriteFile(nonfree, []byte("not repodata"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	writeTestRepodata(t, filepath.Join(dir, "aarch64-repodata"), "bash-5.0_2")
+
+	next, err := loadArchIndices(config, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Arch("x86_64") != prev.Arch("x86_64") || !next.Kept("x86_64") {
+		t.Error("x86_64 was not kept from the previous load")
+	}
+	if p := next.Arch("aarch64").Package("bash"); p == nil || p.Revision != 2 || next.Kept("aarch64") {
+		t.Errorf("aarch64 was not reloaded: bash = %+v", p)
+	}
+	if errs := next.Errors(); len(errs) != 1 || errs[0].Path != nonfree || errs[0].Arch != "x86_64" {
+		t.Errorf("unexpected errors: %+v", errs)
+	}
+
+	// A strict load fails on the first error.
+	config.Paths = append(config.Paths, filepath.Join(dir, "missing"))
+	config.Policy = loadStrict
+	if _, err := loadArchIndices(config, prev); err == nil {
+		t.Error("strict load succeeded; want error")
+	}
+}
+
+func TestLoadArchIndicesRelative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xq-api-load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	writeTestRepodata(t, "x86_64-repodata", "bash-5.0_1")
+	writeTestRepodata(t, "aarch64-repodata", "bash-5.0_1")
+
+	config := &loadConfig{Paths: []string{"x86_64-repodata", "./aarch64-repodata"}, Policy: loadTolerant}
+	prev, err := loadArchIndices(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A missing file given as a relative path keeps its arch's data.
+	if err := os.Remove("x86_64-repodata"); err != nil {
+		t.Fatal(err)
+	}
+	next, err := loadArchIndices(config, prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Arch("x86_64") != prev.Arch("x86_64") || !next.Kept("x86_64") {
+		t.Error("x86_64 was not kept from the previous load")
+	}
+
+	// A load that leaves no repodata fails, even when errors are tolerated.
+	if err := os.Remove("aarch64-repodata"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadArchIndices(config, nil); err == nil {
+		t.Error("load with no repodata succeeded; want error")
+	}
+}
+
+func TestLoadArchIndicesParallel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xq-api-load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Repositories overlap, so the preferred package depends on the order files are merged in.
+	for _, arch := range []string{"x86_64", "x86_64-musl", "i686", "aarch64"} {
+		writeTestRepodata(t, filepath.Join(dir, arch+"-repodata"), "bash-5.0_1", "zlib-1.2.11_3")
+		writeTestRepodata(t, filepath.Join(dir, "debug", arch+"-repodata"), "bash-5.0_1", "gdb-10.1_1")
+		writeTestRepodata(t, filepath.Join(dir, "nonfree", arch+"-repodata"), "bash-5.1_1", "unrar-6.0.3_1")
+		writeTestRepodata(t, filepath.Join(dir, arch+"-stagedata"), "bash-5.1_2")
+	}
+
+	config := &loadConfig{Paths: []string{dir}, Policy: loadStrict, Workers: 8}
+	index, err := loadArchIndices(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Compare against loading each file one at a time, in the order they're found.
+	files, errs := findRepodataFiles(config.Paths)
+	if len(errs) > 0 {
+		t.Fatal(errs[0].err)
+	}
+	want := map[archKey]*RepoData{}
+	for _, file := range files {
+		rd := want[file.archKey]
+		if rd == nil {
+			rd = NewRepoData()
+			want[file.archKey] = rd
+		}
+		if err := rd.LoadRepo(file.path, file.repo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(want) != len(index.archs)+len(index.staged) {
+		t.Errorf("loaded %d arch and %d staged; want %d total", len(index.archs), len(index.staged), len(want))
+	}
+	for key, rd := range want {
+		rd.buildIndices()
+		got := index.data(key)
+		if got.ETag() != rd.ETag() {
+			t.Errorf("%s: ETag = %s; want %s", key, got.ETag(), rd.ETag())
+		}
+		if p := got.Package("bash"); p == nil || p.PackageVersion != rd.Package("bash").PackageVersion {
+			t.Errorf("%s: bash = %+v; want %s", key, p, rd.Package("bash").PackageVersion)
+		}
+	}
+}
+
+func TestArchIndexETagStaged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xq-api-load")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTestRepodata(t, filepath.Join(dir, "x86_64-repodata"), "bash-5.0_1")
+	config := &loadConfig{Paths: []string{dir}, Policy: loadStrict}
+	index, err := loadArchIndices(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changing only stage data must change the index ETag.
+	writeTestRepodata(t, filepath.Join(dir, "x86_64-stagedata"), "bash-5.1_1")
+	staged, err := loadArchIndices(config, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staged.IndexETag() == index.IndexETag() {
+		t.Errorf("IndexETag() = %s after adding stage data; want a new ETag", staged.IndexETag())
+	}
+}
+
+func TestArchIndexStagedUpdates(t *testing.T) {
+	index := &archIndex{
+		archs: map[string]*RepoData{
+			"x86_64": testRepoData(t, map[string][]string{
+				"current": {"a-1.0_1", "b-1.0_1"},
+				"nonfree": {"c-1.0_1"},
+			}),
+		},
+		staged: map[string]*RepoData{
+			"x86_64": testRepoData(t, map[string][]string{
+				"current": {"a-1.0_1", "b-1.1_1", "new-1.0_1"},
+				"nonfree": {"c-2.0_1"},
+			}),
+			"riscv64": testRepoData(t, map[string][]string{
+				"current": {"x-1.0_1"},
+			}),
+		},
+	}
+	if err := index.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		arch string
+		want []string // staged pkgver <- current pkgver
+	}{
+		{"x86_64", []string{"current/b-1.1_1 <- b-1.0_1", "nonfree/c-2.0_1 <- c-1.0_1", "current/new-1.0_1 <- "}},
+		{"riscv64", []string{"current/x-1.0_1 <- "}},
+		{"i686", nil},
+	}
+	for _, c := range cases {
+		var got []string
+		for _, u := range index.StagedUpdates(c.arch) {
+			s := u.Package.Repository + "/" + u.Package.PackageVersion + " <- "
+			if u.Current != nil {
+				s += u.Current.PackageVersion
+			}
+			got = append(got, s)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("StagedUpdates(%q) = %q; want %q", c.arch, got, c.want)
+		}
+	}
+
+	if got, want := index.Index(), []string{"x86_64"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Index() = %q; want %q", got, want)
+	}
+	if got, want := index.Archs(), []string{"riscv64", "x86_64"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Archs() = %q; want %q", got, want)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// responseCache caches encoded response bodies, and their compressed variants, for responses
+// that are the same for every request until data changes. Entries are keyed by the response's
+// ETag and anything else that identifies the response. Each archIndex has its own cache, so
+// responses for old data are dropped along with it, even if a request still using the old data
+// finishes after new data is set. The zero value is an empty cache.
+type responseCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+// cachedResponse is an encoded response body. Compressed variants are built on first use.
+type cachedResponse struct {
+	body []byte
+
+	mu       sync.Mutex
+	variants map[string][]byte // By content encoding
+}
+
+// Len returns the number of entries in the cache.
+func (c *responseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// get returns the cached response for key. If there is no cached response, val is called and
+// its JSON encoding is cached.
+func (c *responseCache) get(key string, val func() interface{}) (*cachedResponse, error) {
+	c.mu.Lock()
+	entry := c.entries[key]
+	c.mu.Unlock()
+	if entry != nil {
+		return entry, nil
+	}
+
+	// Encode without holding the lock. If two requests encode the same response at once, the
+	// last one is kept.
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(val()); err != nil {
+		return nil, err
+	}
+	entry = &cachedResponse{body: buf.Bytes()}
+
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = map[string]*cachedResponse{}
+	}
+	c.entries[key] = entry
+	c.mu.Unlock()
+	return entry, nil
+}
+
+// variant returns the body compressed with a content encoding. If the body is too small to
+// compress, or it can't be compressed, it returns nil.
+func (r *cachedResponse) variant(encoding string) []byte {
+	if len(r.body) < minCompressSize {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if body, ok := r.variants[encoding]; ok {
+		return body
+	}
+	body, err := compressBytes(encoding, r.body)
+	if err != nil {
+		glog.Warningf("unable to compress response with %s: %v", encoding, err)
+		body = nil
+	}
+	if r.variants == nil {
+		r.variants = map[string][]byte{}
+	}
+	r.variants[encoding] = body
+	return body
+}
+
+// replyCached replies with the response cached in index under key, which must include the
+// response's ETag. index must be the data the response is built from. If the response isn't
+// cached, val is called to build it. The body is compressed with the client's most preferred
+// content encoding, if any.
+func (qr *Querier) replyCached(w http.ResponseWriter, req *http.Request, index *archIndex, key string, val func() interface{}) {
+	entry, err := index.cache.get(key, val)
+	if err != nil {
+		glog.Warningf("unable to encode package result: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setDefaultCacheControl(w.Header())
+	addVary(w.Header(), "Accept-Encoding")
+
+	body := entry.body
+	if enc := negotiateEncoding(req.Header.Get("Accept-Encoding"), responseEncodings); enc != "" {
+		if compressed := entry.variant(enc); compressed != nil {
+			w.Header().Set("Content-Encoding", enc)
+			body = compressed
+		}
+	}
+	qr.writeBody(w, http.StatusOK, "application/json", body)
+}
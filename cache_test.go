@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"zstd;q=0.5, gzip", "gzip"},
+		{"GZIP;Q=0.8, zstd;q=0.8", "zstd"},
+		{"*", "zstd"},
+		{"*;q=0.1, zstd;q=0", "br"},
+		{"gzip, br;q=0.9", "gzip"},
+		{"gzip;q=0, identity", ""},
+		{"deflate", ""},
+	}
+	for _, c := range cases {
+		if got := negotiateEncoding(c.accept, responseEncodings); got != c.want {
+			t.Errorf("negotiateEncoding(%q) = %q; want %q", c.accept, got, c.want)
+		}
+	}
+}
+
+func TestReplyCached(t *testing.T) {
+	pkgvers := make([]string, 200)
+	for i := range pkgvers {
+		pkgvers[i] = "pkg" + strconv.Itoa(i) + "-1.0_1"
+	}
+	rd := testRepoData(t, map[string][]string{"current": pkgvers})
+	qr := NewQuerier(1, 1, 1)
+	index := &archIndex{archs: map[string]*RepoData{"x86_64": rd}}
+	qr.SetData(index)
+
+	get := func(accept string) (body []byte, encoding string) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1/query/x86_64", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		qr.Query(w, req, httprouter.Params{{Key: "arch", Value: "x86_64"}})
+		if w.Code != 200 {
+			t.Fatalf("status = %d; want 200", w.Code)
+		}
+		if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("Vary = %q; want Accept-Encoding", got)
+		}
+		if got, want := w.Header().Get("Content-Length"), w.Body.Len(); got != strconv.Itoa(want) {
+			t.Errorf("Content-Length = %s; want %d", got, want)
+		}
+		return w.Body.Bytes(), w.Header().Get("Content-Encoding")
+	}
+
+	plain, enc := get("")
+	if enc != "" {
+		t.Fatalf("Content-Encoding = %q; want none", enc)
+	}
+	if index.cache.Len() != 1 {
+		t.Fatalf("cache has %d entries; want 1", index.cache.Len())
+	}
+
+	body, enc := get("gzip")
+	if enc != "gzip" {
+		t.Fatalf("Content-Encoding = %q; want gzip", enc)
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(gr); !bytes.Equal(got, plain) {
+		t.Error("gzip body does not match uncompressed body")
+	}
+
+	body, enc = get("gzip;q=0.5, zstd")
+	if enc != "zstd" {
+		t.Fatalf("Content-Encoding = %q; want zstd", enc)
+	}
+	zr, err := zstd.NewReader(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := ioutil.ReadAll(zr); !bytes.Equal(got, plain) {
+		t.Error("zstd body does not match uncompressed body")
+	}
+
+	// New data starts with an empty cache, and responses built from old data are never cached
+	// with it.
+	next := &archIndex{archs: map[string]*RepoData{"x86_64": rd}}
+	qr.SetData(next)
+	qr.replyCached(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), index, "stale", func() interface{} { return nil })
+	if next.cache.Len() != 0 {
+		t.Errorf("cache has %d entries after SetData; want 0", next.cache.Len())
+	}
+	get("")
+	if next.cache.Len() != 1 {
+		t.Errorf("cache has %d entries; want 1", next.cache.Len())
+	}
+}
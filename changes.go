@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+type changeKind string
+
+const (
+	changeAdded      changeKind = "added"      // New package
+	changeRemoved    changeKind = "removed"    // Package no longer in repodata
+	changeUpdated    changeKind = "updated"    // Version bumped
+	changeRebuilt    changeKind = "rebuilt"    // Revision bumped, same version
+	changeDowngraded changeKind = "downgraded" // Version or revision went backwards
+)
+
+// packageChange is a change to a package in a repository between two loads of repodata.
+type packageChange struct {
+	ID          uint64     `json:"id"`
+	Time        time.Time  `json:"time"`
+	Kind        changeKind `json:"kind"`
+	Name        string     `json:"name"`
+	Repository  string     `json:"repository"`
+	Version     string     `json:"version,omitempty"`
+	Revision    int        `json:"revision,omitempty"`
+	OldVersion  string     `json:"old_version,omitempty"`
+	OldRevision int        `json:"old_revision,omitempty"`
+
+	// Details of the new package (or the old package, if removed)
+	BuildDate  *timeVal `json:"build_date,omitempty"`
+	Maintainer string   `json:"maintainer,omitempty"`
+	ShortDesc  string   `json:"short_desc,omitempty"`
+}
+
+func newPackageChange(kind changeKind, p, old *packageData) packageChange {
+	c := packageChange{Kind: kind}
+	if old != nil {
+		c.setDetails(old)
+		c.OldVersion, c.OldRevision = old.Version, old.Revision
+	}
+	if p != nil {
+		c.setDetails(p)
+		c.Version, c.Revision = p.Version, p.Revision
+	}
+	return c
+}
+
+func (c *packageChange) setDetails(p *packageData) {
+	c.Name, c.Repository = p.Name, p.Repository
+	c.Maintainer, c.ShortDesc = p.Maintainer, p.ShortDesc
+	c.BuildDate = nil
+	if !time.Time(p.BuildDate).IsZero() {
+		bd := p.BuildDate
+		c.BuildDate = &bd
+	}
+}
+
+// diffRepoData returns the changes between two loads of an arch's repodata. Packages are
+// compared by name and repository, so every candidate for a name is compared. Either old or
+// rd may be nil.
+func diffRepoData(old, rd *RepoData) []packageChange {
+	if old == rd {
+		return nil
+	}
+	var changes []packageChange
+	for _, name := range rd.NameIndex() {
+		prev := old.Candidates(name)
+	next:
+		for _, p := range rd.Candidates(name) {
+			for _, o := range prev {
+				if o.Repository != p.Repository {
+					continue
+				}
+				if kind, ok := compareCandidates(o, p); ok {
+					changes = append(changes, newPackageChange(kind, p, o))
+				}
+				continue next
+			}
+			changes = append(changes, newPackageChange(changeAdded, p, nil))
+		}
+	}
+
+	for _, name := range old.NameIndex() {
+	removed:
+		for _, o := range old.Candidates(name) {
+			for _, p := range rd.Candidates(name) {
+				if p.Repository == o.Repository {
+					continue removed
+				}
+			}
+			changes = append(changes, newPackageChange(changeRemoved, nil, o))
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		if changes[i].Name != changes[j].Name {
+			return changes[i].Name < changes[j].Name
+		}
+		return changes[i].Repository < changes[j].Repository
+	})
+	return changes
+}
+
+// compareCandidates returns the kind of change from old to p, if any.
+func compareCandidates(old, p *packageData) (kind changeKind, changed bool) {
+	if old.PackageVersion == p.PackageVersion {
+		return "", false
+	}
+	switch cmp := CompareVersions(p.VersionRevision(), old.VersionRevision()); {
+	case cmp < 0:
+		return changeDowngraded, true
+	case p.Version == old.Version:
+		return changeRebuilt, true
+	}
+	return changeUpdated, true
+}
+
+// diffArchIndices returns the changes between two arch indices, by arch.
+func diffArchIndices(old, next *archIndex) map[string][]packageChange {
+	diffs := map[string][]packageChange{}
+	for _, arch := range next.Index() {
+		if changes := diffRepoData(old.Arch(arch), next.Arch(arch)); len(changes) > 0 {
+			diffs[arch] = changes
+		}
+	}
+	for _, arch := range old.Index() {
+		if next.Arch(arch) != nil {
+			continue
+		}
+		if changes := diffRepoData(old.Arch(arch), nil); len(changes) > 0 {
+			diffs[arch] = changes
+		}
+	}
+	return diffs
+}
+
+// changesDir is the directory, under the state directory, that package changes are kept in.
+const changesDir = "changes"
+
+// changeLog keeps a bounded number of recent package changes per arch. If a log is opened (see
+// OpenLog), changes are also written to it so that they survive restarts.
+type changeLog struct {
+	mu    sync.RWMutex
+	max   int
+	seq   uint64
+	archs map[string]*changeRing
+
+	dir   string                 // Log directory, if open
+	files map[string]*changeFile // Open logs by arch
+}
+
+// changeFile is an arch's on-disk log of changes, one JSON change per line.
+type changeFile struct {
+	*os.File
+	n int // Number of changes in the file
+}
+
+func newChangeLog(max int) *changeLog {
+	if max < 1 {
+		max = 1
+	}
+	return &changeLog{
+		max:   max,
+		archs: map[string]*changeRing{},
+	}
+}
+
+// Add records changes for an arch and returns them. Each change is assigned an ID and time. If
+// the arch has more than the log's maximum number of changes, the oldest changes are discarded.
+func (l *changeLog) Add(arch string, t time.Time, changes []packageChange) []packageChange {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ring := l.archs[arch]
+	if ring == nil {
+		ring = &changeRing{buf: make([]packageChange, l.max)}
+		l.archs[arch] = ring
+	}
+	added := make([]packageChange, len(changes))
+	for i, c := range changes {
+		l.seq++
+		c.ID, c.Time = l.seq, t
+		ring.push(c)
+		added[i] = c
+	}
+	if l.dir != "" {
+		if err := l.write(arch, added); err != nil {
+			glog.Warningf("unable to write %s changes to log: %v", arch, err)
+		}
+	}
+	return added
+}
+
+// OpenLog opens the change logs kept under stateDir, loading the most recent changes for each
+// arch from them. Once open, changes are appended to each arch's log. Logs are rewritten with
+// only the changes kept in memory when opened and whenever they grow to twice that size.
+func (l *changeLog) OpenLog(stateDir string) error {
+	dir := filepath.Join(stateDir, changesDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.dir, l.files = dir, map[string]*changeFile{}
+	for _, fi := range files {
+		arch := strings.TrimSuffix(fi.Name(), ".log")
+		if fi.IsDir() || arch == fi.Name() {
+			continue
+		}
+		if err := l.load(arch); err != nil {
+			return err
+		}
+		if err := l.compact(arch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads the changes in an arch's log into memory. Lines that can't be decoded, such as a
+// partial last line, are skipped.
+func (l *changeLog) load(arch string) error {
+	path := filepath.Join(l.dir, arch+".log")
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ring := l.archs[arch]
+	if ring == nil {
+		ring = &changeRing{buf: make([]packageChange, l.max)}
+		l.archs[arch] = ring
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var c packageChange
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			glog.Warningf("%s:%d: skipping invalid change: %v", path, line, err)
+			continue
+		}
+		ring.push(c)
+		if c.ID > l.seq {
+			l.seq = c.ID
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	return nil
+}
+
+// write appends changes to an arch's log, compacting it if it's grown too large.
+func (l *changeLog) write(arch string, changes []packageChange) error {
+	cf := l.files[arch]
+	if cf == nil || cf.n+len(changes) > 2*l.max {
+		return l.compact(arch)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, c := range changes {
+		if err := enc.Encode(c); err != nil {
+			return err
+		}
+	}
+	if _, err := cf.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	cf.n += len(changes)
+	return nil
+}
+
+// compact rewrites an arch's log with only the changes kept in memory and reopens it for
+// appending.
+func (l *changeLog) compact(arch string) error {
+	path := filepath.Join(l.dir, arch+".log")
+	tmp, err := ioutil.TempFile(l.dir, arch+".log.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	changes := l.archs[arch].since(0)
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, c := range changes {
+		if err := enc.Encode(c); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if cf := l.files[arch]; cf != nil {
+		cf.Close()
+	}
+	l.files[arch] = &changeFile{File: f, n: len(changes)}
+	return nil
+}
+
+// Close closes the change logs, if open.
+func (l *changeLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	for arch, cf := range l.files {
+		if cerr := cf.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(l.files, arch)
+	}
+	l.dir = ""
+	return err
+}
+
+// Since returns the changes for an arch with IDs greater than id, oldest first.
+func (l *changeLog) Since(arch string, id uint64) []packageChange {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.archs[arch].since(id)
+}
+
+// ETag returns an ETag for the changes recorded for an arch.
+func (l *changeLog) ETag(arch string) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	last, ok := l.archs[arch].last()
+	if !ok {
+		return ""
+	}
+	return joinETags(arch,
+		strconv.FormatUint(last.ID, 10),
+		strconv.FormatInt(last.Time.UnixNano(), 10))
+}
+
+// changeRing is a fixed-size ring buffer of changes.
+type changeRing struct {
+	buf  []packageChange
+	head int // Index of the oldest change
+	n    int
+}
+
+func (r *changeRing) push(c packageChange) {
+	if r.n < len(r.buf) {
+		r.buf[(r.head+r.n)%len(r.buf)] = c
+		r.n++
+		return
+	}
+	r.buf[r.head] = c
+	r.head = (r.head + 1) % len(r.buf)
+}
+
+func (r *changeRing) at(i int) packageChange {
+	return r.buf[(r.head+i)%len(r.buf)]
+}
+
+func (r *changeRing) last() (packageChange, bool) {
+	if r == nil || r.n == 0 {
+		return packageChange{}, false
+	}
+	return r.at(r.n - 1), true
+}
+
+func (r *changeRing) since(id uint64) []packageChange {
+	if r == nil {
+		return nil
+	}
+	// IDs are increasing, so search for the first change after id.
+	i := sort.Search(r.n, func(i int) bool { return r.at(i).ID > id })
+	changes := make([]packageChange, 0, r.n-i)
+	for ; i < r.n; i++ {
+		changes = append(changes, r.at(i))
+	}
+	return changes
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// testRepoData returns a RepoData with packages from each repository. Packages are given as
+// pkgvers.
+func testRepoData(t *testing.T, repos map[string][]string) *RepoData {
+	t.Helper()
+	pkgs := map[string][]*packageData{}
+	for repo, pkgvers := range repos {
+		for _, pkgver := range pkgvers {
+			pkgs[repo] = append(pkgs[repo], &packageData{PackageVersion: pkgver})
+		}
+	}
+	return testRepoPackages(t, pkgs)
+}
+
+// testRepoPackages returns a RepoData with packages from each repository. Packages must have
+// their PackageVersion set. Repositories are loaded in the order current, nonfree.
+func testRepoPackages(t *testing.T, repos map[string][]*packageData) *RepoData {
+	t.Helper()
+	rd := NewRepoData()
+	for _, repo := range []string{"current", "nonfree"} {
+		pkgs, ok := repos[repo]
+		if !ok {
+			continue
+		}
+		pkg := packageMap{}
+		for _, p := range pkgs {
+			name, _, _, err := ParseVersionedName(p.PackageVersion)
+			if err != nil {
+				t.Fatalf("bad pkgver %q: %v", p.PackageVersion, err)
+			}
+			pkg[name] = p
+		}
+		if err := rd.mergeRepoIndex(pkg, nil, repo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rd.buildIndices()
+	return rd
+}
+
+func TestDiffRepoData(t *testing.T) {
+	old := testRepoData(t, map[string][]string{
+		"current": {"bash-5.0_1", "curl-7.74.0_1", "glibc-2.32_1", "gone-1.0_1", "zlib-1.2.11_3"},
+		"nonfree": {"unrar-6.0.3_1"},
+	})
+	next := testRepoData(t, map[string][]string{
+		"current": {"bash-5.0_2", "curl-7.75.0_1", "glibc-2.32_1", "new-0.1_1", "zlib-1.2.11_2"},
+		"nonfree": {"unrar-6.0.3_1", "bash-5.0_1"},
+	})
+
+	type change struct {
+		kind changeKind
+		name string
+		repo string
+	}
+	var got []change
+	for _, c := range diffRepoData(old, next) {
+		got = append(got, change{c.Kind, c.Name, c.Repository})
+	}
+	want := []change{
+		{changeRebuilt, "bash", "current"},
+		{changeAdded, "bash", "nonfree"},
+		{changeUpdated, "curl", "current"},
+		{changeRemoved, "gone", "current"},
+		{changeAdded, "new", "current"},
+		{changeDowngraded, "zlib", "current"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffRepoData() =\n\t%v\nwant\n\t%v", got, want)
+	}
+}
+
+func TestChangeLogBounded(t *testing.T) {
+	log := newChangeLog(3)
+	now := time.Now()
+	log.Add("x86_64", now, []packageChange{{Name: "a"}, {Name: "b"}})
+	log.Add("x86_64", now, []packageChange{{Name: "c"}, {Name: "d"}})
+	log.Add("i686", now, []packageChange{{Name: "e"}})
+
+	names := func(changes []packageChange) (names []string) {
+		for _, c := range changes {
+			names = append(names, c.Name)
+		}
+		return names
+	}
+
+	if got, want := names(log.Since("x86_64", 0)), []string{"b", "c", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Since(0) = %v; want %v", got, want)
+	}
+	if got, want := names(log.Since("x86_64", 3)), []string{"d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Since(3) = %v; want %v", got, want)
+	}
+	if got := log.Since("armv6l", 0); len(got) != 0 {
+		t.Errorf("Since(0) for unknown arch = %v; want none", got)
+	}
+}
+
+func TestChangeLogPersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xq-api-changes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2019, 1, 10, 0, 0, 0, 0, time.UTC)
+	log := newChangeLog(2)
+	if err := log.OpenLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		log.Add("x86_64", now, []packageChange{{Kind: changeAdded, Name: name}})
+	}
+	want := log.Since("x86_64", 0)
+	if err := log.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The log is compacted instead of growing without bound.
+	data, err := ioutil.ReadFile(filepath.Join(dir, changesDir, "x86_64.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines > 4 {
+		t.Errorf("log has %d changes; want at most 4", lines)
+	}
+
+	log = newChangeLog(2)
+	if err := log.OpenLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	if got := log.Since("x86_64", 0); !reflect.DeepEqual(got, want) {
+		t.Errorf("Since(0) after reopening = %+v; want %+v", got, want)
+	}
+	if added := log.Add("x86_64", now, []packageChange{{Name: "f"}}); added[0].ID != 6 {
+		t.Errorf("ID after reopening = %d; want 6", added[0].ID)
+	}
+}
+
+func TestFeedID(t *testing.T) {
+	filter := feedFilter{Repository: "current", Maintainer: "Jane Doe"}
+	a := httptest.NewRequest("GET", "http://a.example.org/v1/feeds/x86_64?maintainer=Jane+Doe&repo=current", nil)
+	b := httptest.NewRequest("GET", "https://b.example.org/v1/feeds/x86_64?repo=current&maintainer=Jane%20Doe", nil)
+	idA, idB := buildFeed(a, "x86_64", nil, filter).ID, buildFeed(b, "x86_64", nil, filter).ID
+	if want := "urn:xq-api:x86_64:feed:repo=current:maintainer=Jane+Doe"; idA != want || idB != want {
+		t.Errorf("feed IDs = %q, %q; want %q", idA, idB, want)
+	}
+}
+
+func TestFeedHead(t *testing.T) {
+	qr := NewQuerier(1, 100, 1)
+	changes := make([]packageChange, 20)
+	for i := range changes {
+		changes[i] = packageChange{Kind: changeAdded, Name: "pkg" + strconv.Itoa(i), Repository: "current", Version: "1.0", Revision: 1}
+	}
+	qr.changes.Add("x86_64", time.Now(), changes)
+
+	h := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		qr.Feed(w, req, httprouter.Params{{Key: "arch", Value: "x86_64"}})
+	}))
+	get := func(method string) http.Header {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/v1/feeds/x86_64", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		h.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("%s /v1/feeds/x86_64: status = %d; want 200", method, w.Code)
+		}
+		return w.Header()
+	}
+
+	getHeader, headHeader := get("GET"), get("HEAD")
+	if getHeader.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("GET Content-Encoding = %q; want gzip", getHeader.Get("Content-Encoding"))
+	}
+	for _, key := range []string{"Content-Encoding", "Content-Length", "Content-Type", "Etag"} {
+		if got, want := headHeader.Get(key), getHeader.Get(key); got != want {
+			t.Errorf("HEAD %s = %q; want %q (as GET)", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import "strings"
+
+// This is a port of the dewey version comparison used by xbps (lib/external/dewey.c), which is
+// itself derived from the NetBSD pkg_install sources. Versions are converted to a list of
+// integer components and compared component by component, with the revision (the number
+// following the last underscore) compared last.
+
+// Modifier values. These sort below 0 so that 1.0alpha < 1.0beta < 1.0rc < 1.0 < 1.0.1.
+const (
+	deweyAlpha = -3
+	deweyBeta  = -2
+	deweyRC    = -1
+	deweyDot   = 0
+)
+
+var deweyModifiers = []struct {
+	s string
+	v int
+}{
+	{"alpha", deweyAlpha},
+	{"beta", deweyBeta},
+	{"pre", deweyRC},
+	{"rc", deweyRC},
+	{"pl", deweyDot},
+	{".", deweyDot},
+}
+
+// deweyVersion is a version string converted to comparable components.
+type deweyVersion struct {
+	v        []int
+	revision int
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isAlpha(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func hasPrefixFold(s, prefix string) bool {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// component consumes a single component of a version string, appends it to d (if it yields
+// a component), and returns the number of bytes consumed.
+func (d *deweyVersion) component(s string) int {
+	if isDigit(s[0]) {
+		i, n := 0, 0
+		for ; i < len(s) && isDigit(s[i]); i++ {
+			n = n*10 + int(s[i]-'0')
+		}
+		d.v = append(d.v, n)
+		return i
+	}
+
+	for _, mod := range deweyModifiers {
+		if hasPrefixFold(s, mod.s) {
+			d.v = append(d.v, mod.v)
+			return len(mod.s)
+		}
+	}
+
+	if s[0] == '_' {
+		i, n := 1, 0
+		for ; i < len(s) && isDigit(s[i]); i++ {
+			n = n*10 + int(s[i]-'0')
+		}
+		d.revision = n
+		return i
+	}
+
+	if c := s[0]; isAlpha(c) {
+		if c < 'a' {
+			c += 'a' - 'A'
+		}
+		d.v = append(d.v, deweyDot, int(c-'a')+1)
+		return 1
+	}
+
+	// Anything else (e.g., ':' in epochs or '+') is skipped.
+	return 1
+}
+
+func parseDewey(s string) deweyVersion {
+	var d deweyVersion
+	for len(s) > 0 {
+		s = s[d.component(s):]
+	}
+	return d
+}
+
+func (d deweyVersion) digit(i int) int {
+	if i < len(d.v) {
+		return d.v[i]
+	}
+	return 0
+}
+
+func (d deweyVersion) compare(o deweyVersion) int {
+	n := len(d.v)
+	if len(o.v) > n {
+		n = len(o.v)
+	}
+	for i := 0; i < n; i++ {
+		if c := d.digit(i) - o.digit(i); c != 0 {
+			return sign(c)
+		}
+	}
+	return sign(d.revision - o.revision)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// CompareVersions compares two versions using the same rules as xbps_cmpver. Versions may
+// include a revision suffix (e.g., "1.0_2"). It returns -1 if a is older than b, 1 if a is newer
+// than b, and 0 if they are equivalent.
+func CompareVersions(a, b string) int {
+	return parseDewey(a).compare(parseDewey(b))
+}
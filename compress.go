@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/golang/glog"
+)
+
+// compressHandler compresses responses from next with the content encoding the client prefers,
+// according to its Accept-Encoding header. Responses that set a Content-Length are compressed
+// whole so that their Content-Length stays correct, and are passed through unchanged if their body
+// doesn't match it. Other responses are compressed as they're written. Responses that already
+// have a Content-Encoding, or are smaller than minCompressSize, are not compressed.
+func compressHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		addVary(w.Header(), "Accept-Encoding")
+		encoding := negotiateEncoding(req.Header.Get("Accept-Encoding"), responseEncodings)
+		if encoding == "" {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.Close()
+		next.ServeHTTP(cw, req)
+	})
+}
+
+// compressWriter is a ResponseWriter that compresses the response body. The body is buffered
+// until it's known whether it's worth compressing.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+
+	code   int   // Status code, once WriteHeader is called
+	length int64 // Content-Length set by the handler, or -1 if not set
+	buf    []byte
+
+	decided bool    // Whether the response has been passed through or compressed
+	enc     encoder // Streaming encoder, if compressing a response without a Content-Length
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.code != 0 {
+		return
+	}
+	cw.code = code
+
+	h := cw.Header()
+	cw.length = -1
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			cw.length = n
+		}
+	}
+
+	switch {
+	case code < 200, code == http.StatusNoContent, code == http.StatusNotModified,
+		h.Get("Content-Encoding") != "",
+		cw.length >= 0 && cw.length < minCompressSize:
+		_ = cw.passthrough()
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.code == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.enc != nil {
+			return cw.enc.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+
+	cw.buf = append(cw.buf, p...)
+	switch {
+	case cw.length >= 0 && int64(len(cw.buf)) > cw.length:
+		// The body is longer than its Content-Length, so leave it to the ResponseWriter to
+		// reject the excess.
+		if err := cw.passthrough(); err != nil {
+			return 0, err
+		}
+	case cw.length < 0 && len(cw.buf) >= minCompressSize:
+		if err := cw.startStream(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes any buffered body to the client. A response without a Content-Length that's
+// flushed before it's decided whether to compress it is compressed.
+func (cw *compressWriter) Flush() {
+	if cw.code == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided && cw.length < 0 {
+		if err := cw.startStream(); err != nil {
+			return
+		}
+	}
+	if cw.enc != nil {
+		if err := cw.enc.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close writes whatever remains of the response. It must be called once the handler returns.
+func (cw *compressWriter) Close() {
+	switch {
+	case cw.code == 0:
+		// Nothing was written.
+	case cw.enc != nil:
+		if err := cw.enc.Close(); err != nil {
+			glog.Warningf("error compressing response with %s: %v", cw.encoding, err)
+		}
+		putEncoder(cw.encoding, cw.enc)
+		cw.enc = nil
+	case cw.decided:
+	case cw.length >= 0 && int64(len(cw.buf)) == cw.length:
+		cw.compressWhole()
+	default:
+		// The body is too small to compress or is shorter than its Content-Length.
+		_ = cw.passthrough()
+	}
+}
+
+// passthrough writes the response header and any buffered body without compressing it.
+func (cw *compressWriter) passthrough() error {
+	cw.decided = true
+	cw.ResponseWriter.WriteHeader(cw.code)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	_, err := cw.ResponseWriter.Write(cw.buf)
+	cw.buf = nil
+	return err
+}
+
+// compressWhole compresses the entire buffered body and writes it with its compressed length.
+func (cw *compressWriter) compressWhole() {
+	body, err := compressBytes(cw.encoding, cw.buf)
+	if err != nil {
+		glog.Warningf("unable to compress response with %s: %v", cw.encoding, err)
+		_ = cw.passthrough()
+		return
+	}
+
+	cw.decided = true
+	h := cw.Header()
+	cw.setContentType()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	cw.ResponseWriter.WriteHeader(cw.code)
+	_, _ = cw.ResponseWriter.Write(body)
+	cw.buf = nil
+}
+
+// startStream starts compressing the response as it's written, beginning with the buffered body.
+func (cw *compressWriter) startStream() error {
+	cw.decided = true
+	h := cw.Header()
+	cw.setContentType()
+	h.Set("Content-Encoding", cw.encoding)
+	h.Del("Content-Length")
+	cw.ResponseWriter.WriteHeader(cw.code)
+
+	cw.enc = getEncoder(cw.encoding, cw.ResponseWriter)
+	buf := cw.buf
+	cw.buf = nil
+	_, err := cw.enc.Write(buf)
+	return err
+}
+
+// setContentType sets the Content-Type from the buffered body if the handler didn't set one,
+// since it can't be detected from the compressed body.
+func (cw *compressWriter) setContentType() {
+	if h := cw.Header(); h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestCompressHandler(t *testing.T) {
+	qr := NewQuerier(1, 1, 1)
+	large := map[string]string{"data": strings.Repeat("xq-api ", 1000)}
+	h := compressHandler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/reply":
+			qr.reply(w, http.StatusOK, large)
+		case "/small":
+			qr.reply(w, http.StatusOK, map[string]string{"data": "small"})
+		case "/stream":
+			for i := 0; i < 1000; i++ {
+				io.WriteString(w, "xq-api ")
+			}
+		case "/long":
+			w.Header().Set("Content-Length", "2000")
+			for i := 0; i < 1000; i++ {
+				io.WriteString(w, "xq-api ")
+			}
+		}
+	}))
+
+	decoders := map[string]func(io.Reader) (io.Reader, error){
+		"": func(r io.Reader) (io.Reader, error) { return r, nil },
+		"br": func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+		"zstd": func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	}
+
+	cases := []struct {
+		path, accept, encoding string
+		length                 bool
+	}{
+		{"/reply", "br, zstd;q=0.9", "br", true},
+		{"/reply", "zstd, br", "zstd", true},
+		{"/reply", "identity", "", true},
+		{"/small", "zstd", "", true},
+		{"/stream", "zstd", "zstd", false},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", c.path, nil)
+		req.Header.Set("Accept-Encoding", c.accept)
+		h.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Content-Encoding"); got != c.encoding {
+			t.Errorf("%s (%s): Content-Encoding = %q; want %q", c.path, c.accept, got, c.encoding)
+			continue
+		}
+		if got := w.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%s (%s): Vary = %q; want Accept-Encoding", c.path, c.accept, got)
+		}
+		cl := w.Header().Get("Content-Length")
+		if c.length && cl != strconv.Itoa(w.Body.Len()) {
+			t.Errorf("%s (%s): Content-Length = %q; want %d", c.path, c.accept, cl, w.Body.Len())
+		} else if !c.length && cl != "" {
+			t.Errorf("%s (%s): Content-Length = %q; want none", c.path, c.accept, cl)
+		}
+
+		r, err := decoders[c.encoding](bytes.NewReader(w.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("%s (%s): error decoding body: %v", c.path, c.accept, err)
+		} else if !bytes.Contains(body, []byte("xq-api ")) && c.path != "/small" {
+			t.Errorf("%s (%s): decoded body = %.40q...", c.path, c.accept, body)
+		}
+	}
+
+	// A body longer than its Content-Length is passed through unchanged, leaving the declared
+	// length for the server to enforce.
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/long", nil)
+	req.Header.Set("Accept-Encoding", "zstd")
+	h.ServeHTTP(w, req)
+	if got := w.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("/long: Content-Encoding = %q; want none", got)
+	}
+	if got := w.Header().Get("Content-Length"); got != "2000" {
+		t.Errorf("/long: Content-Length = %q; want 2000", got)
+	}
+	if w.Body.Len() != 7000 {
+		t.Errorf("/long: wrote %d bytes; want 7000", w.Body.Len())
+	}
+}
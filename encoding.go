@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// minCompressSize is the smallest response body that's compressed. Smaller bodies usually don't
+// shrink enough to be worth it.
+const minCompressSize = 1400
+
+// brotliLevel is the quality used for brotli. Higher levels are too slow to compress responses
+// as they're served.
+const brotliLevel = 5
+
+// responseEncodings are the content encodings that responses can be compressed with, in order of
+// preference when a client accepts more than one equally.
+var responseEncodings = []string{"zstd", "br", "gzip"}
+
+// encoder is a streaming compressor that can be reused by resetting it.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// encoderPools hold reusable encoders by content encoding.
+var encoderPools = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(nil, brotliLevel)
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(nil)
+	}},
+	"zstd": {New: func() interface{} {
+		enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+}
+
+// getEncoder returns an encoder for a content encoding that writes to w. It returns nil if the
+// encoding isn't supported. The encoder should be returned with putEncoder once it's closed.
+func getEncoder(encoding string, w io.Writer) encoder {
+	pool := encoderPools[encoding]
+	if pool == nil {
+		return nil
+	}
+	enc := pool.Get().(encoder)
+	enc.Reset(w)
+	return enc
+}
+
+func putEncoder(encoding string, enc encoder) {
+	encoderPools[encoding].Put(enc)
+}
+
+// compressBytes returns p compressed with a content encoding.
+func compressBytes(encoding string, p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := getEncoder(encoding, &buf)
+	if enc == nil {
+		return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+	defer putEncoder(encoding, enc)
+	if _, err := enc.Write(p); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// negotiateEncoding returns the content encoding in offers that's most acceptable according to an
+// Accept-Encoding header. If the client accepts more than one offer equally, the first is
+// returned. If no offer is acceptable, it returns an empty string (i.e., identity).
+func negotiateEncoding(accept string, offers []string) string {
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value given to coding by an Accept-Encoding header. A coding that
+// isn't listed is given the q-value of "*", if present, or 0.
+func acceptQuality(accept, coding string) float64 {
+	q, wildcard := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params := part, ""
+		if semi := strings.IndexByte(part, ';'); semi != -1 {
+			name, params = part[:semi], part[semi+1:]
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name != coding && name != "*" {
+			continue
+		}
+
+		pq := 1.0
+		for _, param := range strings.Split(params, ";") {
+			param = strings.TrimSpace(param)
+			if len(param) < 2 || (param[0] != 'q' && param[0] != 'Q') || param[1] != '=' {
+				continue
+			}
+			v, err := strconv.ParseFloat(param[2:], 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+			pq = v
+		}
+
+		if name == "*" {
+			wildcard = pq
+		} else {
+			q = pq
+		}
+	}
+	switch {
+	case q >= 0:
+		return q
+	case wildcard >= 0:
+		return wildcard
+	}
+	return 0
+}
+
+// addVary adds field to the Vary header of h, if it isn't already there.
+func addVary(h http.Header, field string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", field)
+}
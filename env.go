@@ -3,7 +3,9 @@ package main
 import (
 	"os"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 )
 
 // etoi looks up an environment variable by name and, if defined, parses it as an integer, and
@@ -65,3 +67,32 @@ func etod(name string, def time.Duration) time.Duration {
 	}
 	return d
 }
+
+// etoss looks up an environment variable and, if defined, splits it into fields separated by
+// whitespace or commas and returns them. If the environment variable isn't defined, it returns
+// def.
+func etoss(name string, def []string) []string {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	return strings.FieldsFunc(v, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// etof looks up an environment variable and, if defined, parses it as a float and returns the
+// parsed float. If the environment variable isn't defined or cannot be parsed, it returns def.
+//
+// Valid float strings are those supported by strconv.ParseFloat.
+func etof(name string, def float64) float64 {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def
+	}
+	return f
+}
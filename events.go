@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// eventKeepAlive is how often a comment is sent to idle event streams to keep proxies from
+	// closing them.
+	eventKeepAlive = 30 * time.Second
+
+	// eventBuffer is the number of events that may be waiting to be written to a single
+	// stream. Streams that fall further behind are closed, and may resume with Last-Event-ID.
+	eventBuffer = 32
+)
+
+// Event types
+const (
+	eventReload  = "reload"  // New data was installed by SetData
+	eventChanges = "changes" // Package changes were recorded for an arch
+	eventReset   = "reset"   // Events were missed and cannot be resumed
+)
+
+// event is a single server-sent event. Data is encoded as JSON when the event is published.
+type event struct {
+	ID   uint64
+	Type string
+	Data []byte
+}
+
+// reloadEvent is the data of a reload event.
+type reloadEvent struct {
+	Time     time.Time         `json:"time"`
+	Duration float64           `json:"duration"` // Seconds taken to load repodata
+	Packages int               `json:"packages"`
+	Archs    []reloadEventArch `json:"archs"`
+}
+
+type reloadEventArch struct {
+	Arch     string `json:"arch"`
+	ETag     string `json:"etag,omitempty"` // Empty if the arch was removed
+	Packages int    `json:"packages"`
+	Changed  bool   `json:"changed"`
+}
+
+// changesEvent is the data of a changes event.
+type changesEvent struct {
+	Arch    string          `json:"arch"`
+	Changes []packageChange `json:"changes"`
+}
+
+// eventBroker publishes events to subscribed streams and keeps a bounded backlog of recent
+// events so that streams may resume where they left off.
+type eventBroker struct {
+	mu      sync.Mutex
+	seq     uint64
+	backlog []event // Oldest first
+	max     int
+	subs    map[chan event]struct{}
+}
+
+func newEventBroker(max int) *eventBroker {
+	if max < 1 {
+		max = 1
+	}
+	return &eventBroker{
+		max:  max,
+		subs: map[chan event]struct{}{},
+	}
+}
+
+// Publish encodes data and sends it as an event to all subscribers.
+func (b *eventBroker) Publish(typ string, data interface{}) {
+	p, err := json.Marshal(data)
+	if err != nil {
+		glog.Warningf("unable to encode %s event: %v", typ, err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	ev := event{ID: b.seq, Type: typ, Data: p}
+	if len(b.backlog) >= b.max {
+		b.backlog = append(b.backlog[:0], b.backlog[len(b.backlog)-b.max+1:]...)
+	}
+	b.backlog = append(b.backlog, ev)
+
+	for sub := range b.subs {
+		select {
+		case sub <- ev:
+		default:
+			// Too far behind -- drop the stream so that it reconnects.
+			delete(b.subs, sub)
+			close(sub)
+		}
+	}
+}
+
+// Subscribe returns a channel of events published after lastID, starting with any events in the
+// backlog. If lastID is 0, only new events are sent. If events after lastID are no longer in the
+// backlog, missed is true. The channel is closed if the subscriber falls behind or is
+// unsubscribed.
+func (b *eventBroker) Subscribe(lastID uint64) (sub chan event, backlog []event, missed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case lastID == 0:
+		lastID = b.seq
+	case lastID > b.seq:
+		// From a previous process
+		missed, lastID = true, 0
+	case len(b.backlog) > 0 && lastID+1 < b.backlog[0].ID:
+		missed = true
+	}
+	for _, ev := range b.backlog {
+		if ev.ID > lastID {
+			backlog = append(backlog, ev)
+		}
+	}
+
+	sub = make(chan event, eventBuffer)
+	b.subs[sub] = struct{}{}
+	return sub, backlog, missed
+}
+
+func (b *eventBroker) Unsubscribe(sub chan event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub)
+	}
+}
+
+// publishReload publishes a reload event for new data replacing prev.
+func (b *eventBroker) publishReload(prev, index *archIndex) {
+	ev := reloadEvent{
+		Time:     index.loadedAt,
+		Duration: index.loadDuration.Seconds(),
+		Archs:    []reloadEventArch{},
+	}
+	for _, arch := range index.Index() {
+		rd := index.Arch(arch)
+		etag := rd.ETag()
+		ev.Packages += len(rd.Index())
+		ev.Archs = append(ev.Archs, reloadEventArch{
+			Arch:     arch,
+			ETag:     etag,
+			Packages: len(rd.Index()),
+			Changed:  etag != prev.Arch(arch).ETag(),
+		})
+	}
+	for _, arch := range prev.Index() {
+		if index.Arch(arch) == nil {
+			ev.Archs = append(ev.Archs, reloadEventArch{Arch: arch, Changed: true})
+		}
+	}
+	b.Publish(eventReload, ev)
+}
+
+func writeEvent(w http.ResponseWriter, ev event) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, ev.Data)
+	return err
+}
@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestEventBrokerResume(t *testing.T) {
+	b := newEventBroker(3)
+	for i := 0; i < 5; i++ {
+		b.Publish(eventReload, i)
+	}
+
+	ids := func(events []event) []uint64 {
+		var ids []uint64
+		for _, ev := range events {
+			ids = append(ids, ev.ID)
+		}
+		return ids
+	}
+
+	cases := []struct {
+		lastID uint64
+		want   []uint64
+		missed bool
+	}{
+		{0, nil, false},
+		{1, []uint64{3, 4, 5}, true},
+		{2, []uint64{3, 4, 5}, false},
+		{4, []uint64{5}, false},
+		{5, nil, false},
+		{9, []uint64{3, 4, 5}, true}, // From a previous process
+	}
+	for _, c := range cases {
+		sub, backlog, missed := b.Subscribe(c.lastID)
+		b.Unsubscribe(sub)
+		if got := ids(backlog); !equalIDs(got, c.want) || missed != c.missed {
+			t.Errorf("Subscribe(%d) = %v, missed=%t; want %v, missed=%t", c.lastID, got, missed, c.want, c.missed)
+		}
+	}
+
+	sub, _, _ := b.Subscribe(5)
+	defer b.Unsubscribe(sub)
+	b.Publish(eventChanges, nil)
+	if ev := <-sub; ev.ID != 6 || ev.Type != eventChanges || string(ev.Data) != "null" {
+		t.Errorf("got event %d %s %s; want 6 changes null", ev.ID, ev.Type, ev.Data)
+	}
+}
+
+func equalIDs(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	atomNamespace   = "http://www.w3.org/2005/Atom"
+	atomContentType = "application/atom+xml"
+)
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	XMLNS   string      `xml:"xmlns,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Author     *atomPerson    `xml:"author,omitempty"`
+	Links      []atomLink     `xml:"link"`
+	Categories []atomCategory `xml:"category"`
+	Summary    string         `xml:"summary,omitempty"`
+}
+
+// feedFilter selects which changes are included in a feed.
+type feedFilter struct {
+	Repository string
+	Maintainer string // Case-insensitive substring
+	Package    string
+}
+
+func (f feedFilter) match(c *packageChange) bool {
+	return (f.Repository == "" || c.Repository == f.Repository) &&
+		(f.Package == "" || c.Name == f.Package) &&
+		(f.Maintainer == "" ||
+			strings.Contains(strings.ToLower(c.Maintainer), strings.ToLower(f.Maintainer)))
+}
+
+// feedID returns a stable ID for the feed of an arch's changes selected by f. It doesn't depend
+// on how the feed was requested (e.g., the host or order of query parameters), so the same feed
+// has the same ID behind any proxy.
+func (f feedFilter) feedID(arch string) string {
+	id := "urn:xq-api:" + url.PathEscape(arch) + ":feed"
+	for _, param := range []struct{ name, value string }{
+		{"repo", f.Repository},
+		{"maintainer", f.Maintainer},
+		{"package", f.Package},
+	} {
+		if param.value != "" {
+			id += ":" + param.name + "=" + url.QueryEscape(param.value)
+		}
+	}
+	return id
+}
+
+// requestBaseURL returns the scheme and host that a request was made to.
+func requestBaseURL(req *http.Request) *url.URL {
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return &url.URL{Scheme: scheme, Host: req.Host}
+}
+
+// parseMaintainer splits a maintainer string of the form "Name <email>".
+func parseMaintainer(s string) atomPerson {
+	if lt := strings.LastIndexByte(s, '<'); lt != -1 && strings.HasSuffix(s, ">") {
+		return atomPerson{
+			Name:  strings.TrimSpace(s[:lt]),
+			Email: s[lt+1 : len(s)-1],
+		}
+	}
+	return atomPerson{Name: s}
+}
+
+// buildFeed builds an Atom feed of changes for an arch, newest first. Entries are timestamped
+// with the build date of the changed package, if known, and otherwise the time of the change.
+func buildFeed(req *http.Request, arch string, changes []packageChange, filter feedFilter) *atomFeed {
+	base := requestBaseURL(req)
+	self := *base
+	self.Path, self.RawQuery = req.URL.Path, req.URL.RawQuery
+
+	feed := &atomFeed{
+		XMLNS:  atomNamespace,
+		ID:     filter.feedID(arch),
+		Title:  "xq-api: " + arch + " package updates",
+		Author: atomPerson{Name: "xq-api"},
+		Links: []atomLink{
+			{Rel: "self", Type: atomContentType, Href: self.String()},
+		},
+		Entries: []atomEntry{},
+	}
+
+	var updated time.Time
+	for i := len(changes) - 1; i >= 0; i-- {
+		c := &changes[i]
+		if !filter.match(c) {
+			continue
+		}
+
+		ts := c.Time
+		if c.BuildDate != nil {
+			ts = time.Time(*c.BuildDate)
+		}
+		if ts.After(updated) {
+			updated = ts
+		}
+
+		link := *base
+		link.Path = "/v1/packages/" + arch + "/" + c.Name
+
+		pkgver := c.Name
+		if c.Kind == changeRemoved {
+			pkgver += "-" + c.OldVersion + "_" + strconv.Itoa(c.OldRevision)
+		} else {
+			pkgver += "-" + c.Version + "_" + strconv.Itoa(c.Revision)
+		}
+
+		title := fmt.Sprintf("%s %s (%s)", pkgver, c.Kind, c.Repository)
+		if c.OldVersion != "" && c.Kind != changeRemoved {
+			title = fmt.Sprintf("%s %s from %s_%d (%s)",
+				pkgver, c.Kind, c.OldVersion, c.OldRevision, c.Repository)
+		}
+
+		entry := atomEntry{
+			// Change IDs aren't stable across restarts, so identify entries by what
+			// changed instead.
+			ID:         "urn:xq-api:" + arch + ":" + c.Repository + ":" + pkgver + ":" + string(c.Kind),
+			Title:      title,
+			Updated:    ts.UTC().Format(time.RFC3339),
+			Links:      []atomLink{{Rel: "alternate", Type: "application/json", Href: link.String()}},
+			Categories: []atomCategory{{Term: c.Repository}, {Term: string(c.Kind)}},
+			Summary:    c.ShortDesc,
+		}
+		if c.Maintainer != "" {
+			author := parseMaintainer(c.Maintainer)
+			entry.Author = &author
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	if updated.IsZero() && len(changes) > 0 {
+		updated = changes[len(changes)-1].Time
+	} else if updated.IsZero() {
+		updated = time.Now()
+	}
+	feed.Updated = updated.UTC().Format(time.RFC3339)
+	return feed
+}
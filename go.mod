@@ -3,7 +3,7 @@ module go.spiff.io/xq-api
 go 1.15
 
 require (
-	github.com/NYTimes/gziphandler v1.0.1
+	github.com/andybalholm/brotli v1.0.4
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/gorilla/handlers v1.4.0
 	github.com/julienschmidt/httprouter v1.2.0
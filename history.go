@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// historyDir is the directory, under the state directory, that package history is kept in.
+const historyDir = "history"
+
+type historyOp string
+
+const (
+	historySeen   historyOp = "seen"   // A pkgver was first seen
+	historyGone   historyOp = "gone"   // A pkgver is no longer present
+	historyReload historyOp = "reload" // Repodata was loaded; all open pkgvers were still present
+)
+
+// historyRecord is a single line of an arch's history log.
+//
+// Reload records are only written when a reload changes something (and when the store is closed),
+// so that the log doesn't grow while nothing changes. Gone records carry the time of the last
+// reload the pkgver was present in, since that reload may not have been written.
+type historyRecord struct {
+	Time       time.Time  `json:"t"`
+	Op         historyOp  `json:"op"`
+	Repository string     `json:"repo,omitempty"`
+	PkgVer     string     `json:"pkgver,omitempty"`
+	LastSeen   *time.Time `json:"last,omitempty"` // Gone records only
+}
+
+// historyEntry is the span of time that a pkgver was present in a repository.
+type historyEntry struct {
+	Repository string    `json:"repository"`
+	Version    string    `json:"version"`
+	Revision   int       `json:"revision"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Current    bool      `json:"current"`
+
+	pkgver string
+}
+
+func (e *historyEntry) key() string {
+	return e.Repository + "\x00" + e.pkgver
+}
+
+// archHistory is the history of every pkgver seen for an arch.
+type archHistory struct {
+	file     *os.File
+	packages map[string][]*historyEntry // By package name, oldest first
+	open     map[string]*historyEntry   // Current entries by repository and pkgver
+
+	lastReload time.Time // Time of the last reload, written to the log or not
+	unlogged   bool      // Whether lastReload has not been written to the log
+}
+
+// historyStore is an append-only, on-disk history of every pkgver seen per arch and
+// repository. Each arch has a log of JSON records under the state directory that is replayed
+// when the store is opened.
+type historyStore struct {
+	mu    sync.RWMutex
+	dir   string
+	archs map[string]*archHistory
+}
+
+// openHistoryStore opens the history kept under stateDir, replaying any existing logs.
+func openHistoryStore(stateDir string) (*historyStore, error) {
+	dir := filepath.Join(stateDir, historyDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	h := &historyStore{
+		dir:   dir,
+		archs: map[string]*archHistory{},
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range files {
+		arch := strings.TrimSuffix(fi.Name(), ".log")
+		if fi.IsDir() || arch == fi.Name() {
+			continue
+		}
+		if _, err := h.arch(arch); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// arch returns the history for an arch, opening and replaying its log if necessary.
+func (h *historyStore) arch(arch string) (*archHistory, error) {
+	if ah := h.archs[arch]; ah != nil {
+		return ah, nil
+	}
+
+	path := filepath.Join(h.dir, arch+".log")
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ah := &archHistory{
+		file:     f,
+		packages: map[string][]*historyEntry{},
+		open:     map[string]*historyEntry{},
+	}
+
+	if err := ah.replay(path); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	h.archs[arch] = ah
+	return ah, nil
+}
+
+// replay applies every record in the log to the in-memory history. If the log ends in a partial
+// line (e.g., from a crash while writing), it's truncated so that the next record written
+// starts on its own line.
+func (ah *archHistory) replay(path string) error {
+	r := bufio.NewReader(ah.file)
+	var offset int64
+	for line := 1; ; line++ {
+		p, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(p) > 0 {
+				glog.Warningf("%s:%d: truncating partial history record", path, line)
+				return ah.file.Truncate(offset)
+			}
+			return nil
+		} else if err != nil {
+			return err
+		}
+		offset += int64(len(p))
+
+		var rec historyRecord
+		if err := json.Unmarshal(p, &rec); err != nil {
+			glog.Warningf("%s:%d: skipping invalid history record: %v", path, line, err)
+			continue
+		}
+		ah.apply(rec)
+	}
+}
+
+// apply applies a record to the in-memory history.
+func (ah *archHistory) apply(rec historyRecord) {
+	switch rec.Op {
+	case historySeen:
+		name, version, revision, err := ParseVersionedName(rec.PkgVer)
+		if err != nil {
+			return
+		}
+		e := &historyEntry{
+			Repository: rec.Repository,
+			Version:    version,
+			Revision:   revision,
+			FirstSeen:  rec.Time,
+			LastSeen:   rec.Time,
+			Current:    true,
+			pkgver:     rec.PkgVer,
+		}
+		ah.packages[name] = append(ah.packages[name], e)
+		ah.open[e.key()] = e
+	case historyGone:
+		key := rec.Repository + "\x00" + rec.PkgVer
+		if e := ah.open[key]; e != nil {
+			// Older logs have a reload record for every reload, so the entry's last reload is
+			// already correct if the record has no time.
+			if rec.LastSeen != nil {
+				e.LastSeen = *rec.LastSeen
+			}
+			e.Current = false
+			delete(ah.open, key)
+		}
+	case historyReload:
+		for _, e := range ah.open {
+			e.LastSeen = rec.Time
+		}
+		ah.lastReload = rec.Time
+	}
+}
+
+// Record records every package loaded for each arch in index. Packages that are no longer
+// present for an arch are marked as gone. Arches not in index are left unchanged.
+func (h *historyStore) Record(index *archIndex, t time.Time) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, arch := range index.Index() {
+		if err := h.recordArch(arch, index.Arch(arch), t); err != nil {
+			return fmt.Errorf("error recording %s history: %w", arch, err)
+		}
+	}
+	return nil
+}
+
+func (h *historyStore) recordArch(arch string, rd *RepoData, t time.Time) error {
+	ah, err := h.arch(arch)
+	if err != nil {
+		return err
+	}
+
+	var recs []historyRecord
+	present := map[string]bool{}
+	for _, name := range rd.NameIndex() {
+		for _, p := range rd.Candidates(name) {
+			key := p.Repository + "\x00" + p.PackageVersion
+			present[key] = true
+			if ah.open[key] == nil {
+				recs = append(recs, historyRecord{Time: t, Op: historySeen, Repository: p.Repository, PkgVer: p.PackageVersion})
+			}
+		}
+	}
+
+	var gone []historyRecord
+	for key, e := range ah.open {
+		if !present[key] {
+			last := e.LastSeen
+			gone = append(gone, historyRecord{Time: t, Op: historyGone, Repository: e.Repository, PkgVer: e.pkgver, LastSeen: &last})
+		}
+	}
+	sort.Slice(gone, func(i, j int) bool {
+		if gone[i].PkgVer != gone[j].PkgVer {
+			return gone[i].PkgVer < gone[j].PkgVer
+		}
+		return gone[i].Repository < gone[j].Repository
+	})
+	recs = append(gone, recs...)
+	reload := historyRecord{Time: t, Op: historyReload}
+
+	// Nothing changed, so only update the in-memory history. The reload is written with the next
+	// change or when the store is closed.
+	if len(recs) == 0 {
+		ah.apply(reload)
+		ah.unlogged = true
+		return nil
+	}
+
+	recs = append(recs, reload)
+	if err := ah.write(recs); err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		ah.apply(rec)
+	}
+	return nil
+}
+
+// write appends records to the log and syncs it.
+func (ah *archHistory) write(recs []historyRecord) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, rec := range recs {
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+	if _, err := ah.file.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := ah.file.Sync(); err != nil {
+		return err
+	}
+	ah.unlogged = false
+	return nil
+}
+
+// Package returns the history of a package for an arch, oldest first.
+func (h *historyStore) Package(arch, name string) []historyEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ah := h.archs[arch]
+	if ah == nil {
+		return nil
+	}
+	entries := make([]historyEntry, len(ah.packages[name]))
+	for i, e := range ah.packages[name] {
+		entries[i] = *e
+	}
+	return entries
+}
+
+func (h *historyStore) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var err error
+	for arch, ah := range h.archs {
+		// Write the last reload so that open entries are last seen at the right time when the
+		// log is replayed.
+		if ah.unlogged {
+			if werr := ah.write([]historyRecord{{Time: ah.lastReload, Op: historyReload}}); werr != nil && err == nil {
+				err = werr
+			}
+		}
+		if cerr := ah.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(h.archs, arch)
+	}
+	return err
+}
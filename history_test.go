@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryStorePersists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xq-api-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	index := func(pkgvers ...string) *archIndex {
+		a := &archIndex{archs: map[string]*RepoData{
+			"x86_64": testRepoData(t, map[string][]string{"current": pkgvers}),
+		}}
+		a.init()
+		return a
+	}
+
+	t0 := time.Date(2019, 1, 10, 0, 0, 0, 0, time.UTC)
+	t1, t1b, t2 := t0.Add(time.Hour), t0.Add(90*time.Minute), t0.Add(2*time.Hour)
+	logPath := filepath.Join(dir, historyDir, "x86_64.log")
+	logSize := func() int64 {
+		fi, err := os.Stat(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fi.Size()
+	}
+
+	h, err := openHistoryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Record(index("foo-1.2_1", "bar-1.0_1"), t0); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Record(index("foo-1.3_1", "bar-1.0_1"), t1); err != nil {
+		t.Fatal(err)
+	}
+	// A reload that changes nothing isn't written until the store is closed.
+	size := logSize()
+	if err := h.Record(index("foo-1.3_1", "bar-1.0_1"), t1b); err != nil {
+		t.Fatal(err)
+	}
+	if logSize() != size {
+		t.Errorf("log grew from %d to %d bytes on a reload with no changes", size, logSize())
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen the store to replay the log and record once more.
+	h, err = openHistoryStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if err := h.Record(index("foo-1.3_1"), t2); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []historyEntry{
+		{Repository: "current", Version: "1.2", Revision: 1, FirstSeen: t0, LastSeen: t0},
+		{Repository: "current", Version: "1.3", Revision: 1, FirstSeen: t1, LastSeen: t2, Current: true},
+	}
+	got := h.Package("x86_64", "foo")
+	if len(got) != len(want) {
+		t.Fatalf("Package(foo) = %+v; want %+v", got, want)
+	}
+	for i := range want {
+		got[i].pkgver = ""
+		if got[i] != want[i] {
+			t.Errorf("Package(foo)[%d] = %+v; want %+v", i, got[i], want[i])
+		}
+	}
+
+	// bar was last present in the reload at t1b, which was only written on close.
+	bar := h.Package("x86_64", "bar")
+	if len(bar) != 1 || bar[0].Current || !bar[0].LastSeen.Equal(t1b) {
+		t.Errorf("Package(bar) = %+v; want one entry last seen at %v", bar, t1b)
+	}
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A partial last line is dropped so the next record starts on its own line.
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"t":"2019-01-10T03:00:00Z","op":"se`)
+	f.Close()
+	if h, err = openHistoryStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.Record(index("foo-1.3_1", "baz-1.0_1"), t2.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	h.Close()
+	if h, err = openHistoryStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if baz := h.Package("x86_64", "baz"); len(baz) != 1 || !baz[0].Current {
+		t.Errorf("Package(baz) = %+v; want one current entry", baz)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// packagePool interns strings and noarch packages shared by repodata loaded together. Most
+// strings in repodata (names, versions, descriptions, dependencies, maintainers, licenses, and so
+// on) repeat many times within an arch and again across archs, and noarch packages are identical
+// in every arch's repodata. A nil pool interns nothing. A pool is safe for concurrent use.
+type packagePool struct {
+	mu      sync.Mutex
+	strings map[string]string
+	lists   map[string][]string
+	urls    map[string]*urlVal
+	noarch  map[noarchKey]*packageData
+	stats   poolStats
+}
+
+// noarchKey identifies a noarch package that can be shared between archs.
+type noarchKey struct {
+	repo   string
+	pkgver string
+	sha256 string
+}
+
+// poolStats describes what a packagePool has interned.
+type poolStats struct {
+	Strings        int   `json:"strings"`         // Unique strings
+	StringBytes    int64 `json:"string_bytes"`    // Size of unique strings
+	Lists          int   `json:"lists"`           // Unique string lists (e.g., run_depends)
+	Packages       int   `json:"packages"`        // Packages interned
+	SharedPackages int   `json:"shared_packages"` // Noarch packages replaced by a shared package
+}
+
+func newPackagePool() *packagePool {
+	return &packagePool{
+		strings: map[string]string{},
+		lists:   map[string][]string{},
+		urls:    map[string]*urlVal{},
+		noarch:  map[noarchKey]*packageData{},
+	}
+}
+
+// Stats returns what the pool has interned so far.
+func (pp *packagePool) Stats() poolStats {
+	if pp == nil {
+		return poolStats{}
+	}
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.stats
+}
+
+// intern returns p with its strings interned. If p is a noarch package that has already been
+// interned for another arch, the existing package is returned instead. p must not be modified
+// after it's interned.
+func (pp *packagePool) intern(p *packageData) *packageData {
+	if pp == nil {
+		return p
+	}
+
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.stats.Packages++
+
+	key := noarchKey{repo: p.Repository, pkgver: p.PackageVersion, sha256: p.FilenameSHA256}
+	noarch := p.Architecture == "noarch" && key.sha256 != ""
+	if shared := pp.noarch[key]; noarch && shared != nil && shared.ETag == p.ETag {
+		pp.stats.SharedPackages++
+		return shared
+	}
+
+	p.PackageVersion = pp.str(p.PackageVersion)
+	p.Name = pp.str(p.Name)
+	p.Version = pp.str(p.Version)
+	p.Repository = pp.str(p.Repository)
+	p.Architecture = pp.str(p.Architecture)
+	p.BuildOptions = pp.str(p.BuildOptions)
+	p.License = pp.str(p.License)
+	p.Maintainer = pp.str(p.Maintainer)
+	p.ShortDesc = pp.str(p.ShortDesc)
+	p.SourceRevisions = pp.str(p.SourceRevisions)
+	p.RunDepends = pp.list(p.RunDepends)
+	p.ShlibRequires = pp.list(p.ShlibRequires)
+	p.ShlibProvides = pp.list(p.ShlibProvides)
+	p.Conflicts = pp.list(p.Conflicts)
+	p.Reverts = pp.list(p.Reverts)
+	p.Replaces = pp.list(p.Replaces)
+	p.ConfFiles = pp.list(p.ConfFiles)
+	if p.Homepage != nil {
+		p.Homepage = pp.url(p.Homepage)
+	}
+
+	if noarch {
+		pp.noarch[key] = p
+	}
+	return p
+}
+
+func (pp *packagePool) str(s string) string {
+	if s == "" {
+		return ""
+	}
+	if is, ok := pp.strings[s]; ok {
+		return is
+	}
+	pp.strings[s] = s
+	pp.stats.Strings++
+	pp.stats.StringBytes += int64(len(s))
+	return s
+}
+
+// list interns each string in ss and returns a shared list equal to ss.
+func (pp *packagePool) list(ss []string) []string {
+	if len(ss) == 0 {
+		return nil
+	}
+	key := strings.Join(ss, "\x00")
+	if list, ok := pp.lists[key]; ok {
+		return list
+	}
+	list := make([]string, len(ss))
+	for i, s := range ss {
+		list[i] = pp.str(s)
+	}
+	pp.lists[key] = list
+	pp.stats.Lists++
+	return list
+}
+
+func (pp *packagePool) url(u *urlVal) *urlVal {
+	text, err := u.MarshalText()
+	if err != nil {
+		return u
+	}
+	key := string(text)
+	if iu, ok := pp.urls[key]; ok {
+		return iu
+	}
+	pp.urls[key] = u
+	return u
+}
@@ -0,0 +1,59 @@
+package main
+
+import "testing"
+
+func TestPackagePoolIntern(t *testing.T) {
+	pool := newPackagePool()
+	newPackage := func(arch, sha256 string) *packageData {
+		// Build strings at runtime so that they aren't already shared.
+		p := &packageData{
+			PackageVersion: string([]byte("font-util-1.3.2_1")),
+			Repository:     "current",
+			Architecture:   arch,
+			FilenameSHA256: sha256,
+			License:        string([]byte("MIT")),
+			RunDepends:     []string{string([]byte("glibc>=2.32_1"))},
+		}
+		p.ETag, _ = p.computeETag()
+		return p
+	}
+
+	a := pool.intern(newPackage("noarch", "abc"))
+	b := pool.intern(newPackage("noarch", "abc"))
+	if a != b {
+		t.Error("identical noarch packages were not shared")
+	}
+
+	c := pool.intern(newPackage("x86_64", "def"))
+	d := pool.intern(newPackage("i686", "ghi"))
+	if c == d {
+		t.Error("packages for different archs were shared")
+	}
+	if &c.RunDepends[0] != &d.RunDepends[0] {
+		t.Error("run_depends were not shared")
+	}
+
+	want := poolStats{Strings: 7, StringBytes: 56, Lists: 1, Packages: 4, SharedPackages: 1}
+	if got := pool.Stats(); got != want {
+		t.Errorf("Stats() = %+v; want %+v", got, want)
+	}
+}
+
+func TestContainsLower(t *testing.T) {
+	cases := []struct {
+		s, substr string
+		want      bool
+	}{
+		{"GNU Bourne Again Shell", "bourne", true},
+		{"GNU Bourne Again Shell", "shell", true},
+		{"GNU Bourne Again Shell", "", true},
+		{"GNU", "gnu bash", false},
+		{"Ärger", "ärg", true},
+		{"bash-5.0_1", "SH", false},
+	}
+	for _, c := range cases {
+		if got := containsLower(c.s, c.substr); got != c.want {
+			t.Errorf("containsLower(%q, %q) = %t; want %t", c.s, c.substr, got, c.want)
+		}
+	}
+}
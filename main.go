@@ -1,6 +1,7 @@
 package main // import "go.spiff.io/xq-api"
 
 import (
+	"context"
 	"flag"
 	"net"
 	"net/http"
@@ -8,15 +9,48 @@ import (
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/NYTimes/gziphandler"
 	"github.com/golang/glog"
 	"github.com/gorilla/handlers"
 	"github.com/julienschmidt/httprouter"
 	"golang.org/x/sys/unix"
 )
 
+// defaultSyncArchs is the default list of architectures synced from mirrors.
+var defaultSyncArchs = []string{
+	"x86_64", "x86_64-musl",
+	"i686", "i686-musl",
+	"armv6l", "armv6l-musl",
+	"armv7l", "armv7l-musl",
+	"aarch64", "aarch64-musl",
+}
+
+// stringsFlag is a flag.Value for a list of strings. The first use of the flag replaces its
+// default values and each use after that appends to the list. Commas separate multiple values
+// in a single use.
+type stringsFlag struct {
+	Values []string
+	set    bool
+}
+
+func (s *stringsFlag) String() string {
+	if s == nil {
+		return ""
+	}
+	return strings.Join(s.Values, ",")
+}
+
+func (s *stringsFlag) Set(v string) error {
+	if !s.set {
+		s.Values, s.set = nil, true
+	}
+	s.Values = append(s.Values, strings.Split(v, ",")...)
+	return nil
+}
+
 func main() {
 	ec := 0
 	defer func() { os.Exit(ec) }()
@@ -35,11 +69,66 @@ func main() {
 			"listen address")
 		logAccess = cli.Bool("log-access", etob("XQAPI_LOG_ACCESS", false),
 			"write access logs to stderr (info)")
+		metricsListen = cli.String("metrics-listen", etos("XQAPI_METRICS_LISTEN", ""),
+			"a separate TCP `address` to serve /metrics on (served with the API if empty)")
 		maxRunning = cli.Int("max-queries", etoi("XQAPI_MAX_QUERIES", 16),
 			"the maximum number of filter queries to allow")
+		queryWait = cli.Duration("query-wait", etod("XQAPI_QUERY_WAIT", 10*time.Second),
+			"how long a query may wait for a free slot before responding 503 (unbounded if `duration` <= 0)")
+		rateLimit = cli.Float64("rate-limit", etof("XQAPI_RATE_LIMIT", 0),
+			"the number of requests per second to allow from each client (disabled if `rate` <= 0)")
+		rateBurst = cli.Int("rate-burst", etoi("XQAPI_RATE_BURST", 20),
+			"the number of requests a client may make at once before it's rate limited")
+		maxChanges = cli.Int("max-changes", etoi("XQAPI_MAX_CHANGES", 1000),
+			"the maximum number of package changes to keep per arch")
+		maxEvents = cli.Int("max-events", etoi("XQAPI_MAX_EVENTS", 100),
+			"the maximum number of events to keep for resuming event streams")
+		readyMaxAge = cli.Duration("ready-max-age", etod("XQAPI_READY_MAX_AGE", 0),
+			"how old repodata may be before /readyz fails (disabled if `age` <= 0)")
 		reloadEvery = cli.Duration("reload-every", etod("XQAPI_RELOAD_EVERY", 0),
 			"how often to reload xbps data (disabled if `interval` <= 0)")
+		watch = cli.Bool("watch", etob("XQAPI_WATCH", false),
+			"reload repodata when it changes (Linux only)")
+		watchDelay = cli.Duration("watch-delay", etod("XQAPI_WATCH_DELAY", 2*time.Second),
+			"how long to wait after repodata stops changing before reloading it")
+		mirrorConfig = cli.String("mirror-config", etos("XQAPI_MIRROR_CONFIG", ""),
+			"an xbps.d(5) `file` to read mirror repository= URLs from")
+		syncDir = cli.String("sync-dir", etos("XQAPI_SYNC_DIR", ""),
+			"the `directory` to download mirror repodata to")
+		stateDir = cli.String("state-dir", etos("XQAPI_STATE_DIR", ""),
+			"a `directory` to keep persistent state, such as package history, in")
+		loadWorkers = cli.Int("load-workers", etoi("XQAPI_LOAD_WORKERS", 0),
+			"the maximum number of repodata files to load in parallel (the number of CPUs if `n` <= 0)")
+		useSnapshot = cli.Bool("snapshot", etob("XQAPI_SNAPSHOT", true),
+			"keep a snapshot of loaded repodata in the state directory to start faster")
+		trustedKeys = cli.String("trusted-keys", etos("XQAPI_TRUSTED_KEYS", ""),
+			"a `directory` of trusted repository keys; if set, repodata not signed by one is rejected")
+		syncEvery = cli.Duration("sync-every", etod("XQAPI_SYNC_EVERY", 0),
+			"how often to sync repodata from mirrors (only on start if `interval` <= 0)")
+		webhookSecret = cli.String("webhook-secret", etos("XQAPI_WEBHOOK_SECRET", ""),
+			"a `secret` to sign webhook payloads with (HMAC-SHA256; required with -webhook)")
+		webhookAttempts = cli.Int("webhook-attempts", etoi("XQAPI_WEBHOOK_ATTEMPTS", 5),
+			"the maximum number of attempts to deliver each webhook")
+		webhookBackoff = cli.Duration("webhook-backoff", etod("XQAPI_WEBHOOK_BACKOFF", 30*time.Second),
+			"how long to wait before retrying a failed webhook (doubled for each retry)")
+		mirrors    = stringsFlag{Values: etoss("XQAPI_MIRRORS", nil)}
+		syncArchs  = stringsFlag{Values: etoss("XQAPI_SYNC_ARCHS", defaultSyncArchs)}
+		webhooks   = stringsFlag{Values: etoss("XQAPI_WEBHOOKS", nil)}
+		proxies    = stringsFlag{Values: etoss("XQAPI_TRUSTED_PROXIES", nil)}
+		loadPolicy = loadTolerant
 	)
+	// As with other environment variables, an invalid policy is ignored.
+	_ = loadPolicy.Set(etos("XQAPI_LOAD_POLICY", string(loadTolerant)))
+	cli.Var(&mirrors, "mirror",
+		"a mirror repository `url` to sync repodata from (may be repeated)")
+	cli.Var(&syncArchs, "sync-archs",
+		"a comma-separated `list` of architectures to sync from mirrors")
+	cli.Var(&loadPolicy, "load-policy",
+		"how to handle repodata that fails to load: `strict` (fail the reload) or tolerant (keep the last good data per arch)")
+	cli.Var(&webhooks, "webhook",
+		"a `url` to POST package changes to after reloading repodata (may be repeated)")
+	cli.Var(&proxies, "trusted-proxy",
+		"an `address` or CIDR block of a proxy whose X-Forwarded-For is used to rate limit clients (may be repeated)")
 	argv := append([]string{
 		// Set by default to avoid creating files.
 		// Can pass -logtostderr=false to override this.
@@ -50,23 +139,91 @@ func main() {
 
 	defer glog.Flush()
 
-	api := NewQuerier(*maxRunning)
-	sv := createServer(api, *logAccess)
+	api := NewQuerier(*maxRunning, *maxChanges, *maxEvents)
+	api.SetMaxDataAge(*readyMaxAge)
+	api.SetQueryWait(*queryWait)
+	if *rateLimit > 0 {
+		limiter, err := newRateLimiter(*rateLimit, *rateBurst, proxies.Values)
+		if err != nil {
+			glog.Errorf("error configuring rate limit: %v", err)
+			exit(1)
+		}
+		api.SetRateLimiter(limiter)
+	}
+	sv := createServer(api, *logAccess, *metricsListen == "")
 
-	// Reload on boot to have data before the server starts (this isn't really strictly
-	// necessary).
-	if err := reloadRepoData(api, flag.Args()); err != nil {
-		glog.Errorf("error loading initial repo data: %v", err)
-		exit(1)
+	if *stateDir != "" {
+		history, err := openHistoryStore(*stateDir)
+		if err != nil {
+			glog.Errorf("error opening package history: %v", err)
+			exit(1)
+		}
+		defer history.Close()
+		api.SetHistory(history)
+
+		if err := api.changes.OpenLog(*stateDir); err != nil {
+			glog.Errorf("error opening package change log: %v", err)
+			exit(1)
+		}
+		defer api.changes.Close()
 	}
 
-	// Reload repodata on hup.
-	go reloadOnSignal(api, flag.Args(), unix.SIGHUP)
+	if len(webhooks.Values) > 0 {
+		if *webhookSecret == "" || *stateDir == "" {
+			glog.Error("-webhook requires -webhook-secret and -state-dir")
+			exit(1)
+		}
+		hooks := &Webhooks{
+			Client:      &http.Client{Timeout: 30 * time.Second},
+			URLs:        webhooks.Values,
+			Secret:      []byte(*webhookSecret),
+			MaxAttempts: *webhookAttempts,
+			Backoff:     *webhookBackoff,
+		}
+		if err := hooks.OpenLog(*stateDir); err != nil {
+			glog.Errorf("error opening webhook delivery log: %v", err)
+			exit(1)
+		}
+		defer hooks.Close()
+		api.SetWebhooks(hooks)
+	}
 
-	// Reload repodata on interval.
-	if interval := *reloadEvery; interval > 0 {
-		glog.Infof("Reloading repo data every %v", interval)
-		go reloadOnInterval(api, flag.Args(), interval)
+	config := &loadConfig{
+		Paths:       flag.Args(),
+		TrustedKeys: *trustedKeys,
+		Policy:      loadPolicy,
+		Workers:     *loadWorkers,
+	}
+	if *stateDir != "" && *useSnapshot {
+		config.Snapshot = snapshotPath(*stateDir)
+	}
+
+	// Configure syncing repodata from mirrors, if any.
+	if *mirrorConfig != "" {
+		configured, err := readMirrorConfig(*mirrorConfig)
+		if err != nil {
+			glog.Errorf("error reading mirror config: %v", err)
+			exit(1)
+		}
+		mirrors.Values = append(mirrors.Values, configured...)
+	}
+	var syncer *Syncer
+	if len(mirrors.Values) > 0 {
+		if *syncDir == "" {
+			glog.Error(errNoSyncDir)
+			exit(1)
+		}
+		syncer = &Syncer{
+			Client:  &http.Client{Timeout: 5 * time.Minute},
+			Dir:     *syncDir,
+			Mirrors: mirrors.Values,
+			Archs:   syncArchs.Values,
+		}
+		if err := syncer.CheckMirrors(); err != nil {
+			glog.Errorf("error configuring mirrors: %v", err)
+			exit(1)
+		}
+		config.Paths = append(config.Paths, *syncDir)
 	}
 
 	// Start handling interrupt/terminate to die cleanly (mostly important for listening on
@@ -76,6 +233,16 @@ func main() {
 		sv.Close()
 	}()
 
+	// Serve metrics on a separate listener, if set.
+	if *metricsListen != "" {
+		msv, err := createMetricsServer(api, *metricsListen)
+		if err != nil {
+			glog.Errorf("unable to listen on %s for metrics: %v", *metricsListen, err)
+			exit(1)
+		}
+		defer msv.Close()
+	}
+
 	// Create listener.
 	listener, err := net.Listen(*network, *listen)
 	if err != nil {
@@ -86,29 +253,108 @@ func main() {
 	glog.Infof("listening: %v", listener.Addr())
 
 	glog.Info("starting server")
-	if err := sv.Serve(listener); err != nil && err != http.ErrServerClosed {
+	served := make(chan error, 1)
+	go func() { served <- sv.Serve(listener) }()
+
+	// Sync repodata from mirrors before loading it.
+	if syncer != nil {
+		_, err := syncer.Sync(context.Background())
+		if err != nil {
+			glog.Warningf("error syncing initial repo data: %v", err)
+		}
+		api.status.synced(time.Now().UTC(), err)
+	}
+
+	// Load data on boot. Until this succeeds, the server responds to requests but is not ready
+	// (see /readyz).
+	if err := reloadRepoData(api, config); err != nil {
+		glog.Errorf("error loading initial repo data: %v", err)
+		exit(1)
+	}
+
+	// Reload repodata on hup.
+	go reloadOnSignal(api, config, unix.SIGHUP)
+
+	// Reload repodata when it changes.
+	if *watch {
+		watcher, err := newRepodataWatcher(config.Paths)
+		if err != nil {
+			glog.Errorf("unable to watch repodata: %v", err)
+			exit(1)
+		}
+		defer watcher.Close()
+		glog.Infof("Reloading repo data on changes after %v", *watchDelay)
+		go watcher.Watch(*watchDelay, func(archs []string) {
+			if err := reloadRepoData(api, config, archs...); err != nil {
+				glog.Warningf("Error reloading repository data on change: %v", err)
+			}
+		})
+	}
+
+	// Reload repodata on interval.
+	if interval := *reloadEvery; interval > 0 {
+		glog.Infof("Reloading repo data every %v", interval)
+		go reloadOnInterval(api, config, interval)
+	}
+
+	// Sync repodata from mirrors on interval.
+	if interval := *syncEvery; interval > 0 && syncer != nil {
+		glog.Infof("Syncing repo data from mirrors every %v", interval)
+		go syncOnInterval(api, syncer, config, interval)
+	}
+
+	if err := <-served; err != nil && err != http.ErrServerClosed {
 		glog.Errorf("server error: %v", err)
 		exit(1)
 	}
 }
 
-func createServer(api *Querier, logAccess bool) *http.Server {
+func createServer(api *Querier, logAccess, serveMetrics bool) *http.Server {
 	mux := httprouter.New()
-	mux.GET("/v1/archs", api.Archs)
-	mux.HEAD("/v1/archs", api.Archs)
-
-	mux.GET("/v1/query/:arch", api.Query)
-	mux.HEAD("/v1/query/:arch", api.Query)
-
-	mux.GET("/v1/packages/:arch", api.PackageList)
-	mux.HEAD("/v1/packages/:arch", api.PackageList)
+	// handleExempt registers a GET and HEAD handler for a route that isn't rate limited.
+	handleExempt := func(route string, h httprouter.Handle) {
+		h = routed(route, h)
+		mux.GET(route, h)
+		mux.HEAD(route, h)
+	}
+	// handle registers a GET and HEAD handler for a route that's rate limited per client.
+	handle := func(route string, h httprouter.Handle) {
+		handleExempt(route, api.RateLimited(h))
+	}
 
-	mux.GET("/v1/packages/:arch/:package", api.Package)
-	mux.HEAD("/v1/packages/:arch/:package", api.Package)
+	handle("/v1/archs", api.Archs)
+	handle("/v1/query/:arch", api.Query)
+	handle("/v1/packages/:arch", api.PackageList)
+	handle("/v1/packages/:arch/:package", api.Package)
+	handle("/v1/packages/:arch/:package/history", api.PackageHistory)
+	handle("/v1/changes/:arch", api.Changes)
+	handle("/v1/feeds/:arch", api.Feed)
+	handle("/v1/staged/:arch", api.Staged)
+	handle("/v1/repos/:arch", api.Repos)
+	handle("/v1/revdeps/:arch/:package", api.RevDeps)
+	handle("/v1/closure/:arch", api.Closure)
+	handle("/v1/shlibs/:arch/:soname", api.Shlibs)
+	handle("/v1/compare", api.Compare)
+	handle("/v1/events", api.Events)
+	handle("/v1/status", api.Status)
+	handleExempt("/healthz", api.Healthz)
+	handleExempt("/readyz", api.Readyz)
+
+	if serveMetrics {
+		handleExempt("/metrics", api.Metrics)
+	}
 
 	mux.NotFound = http.HandlerFunc(api.NotFound)
 
-	zipper := gziphandler.GzipHandler(mux)
+	// Event streams are not compressed, so they bypass compression.
+	compressed := compressHandler(mux)
+	zipper := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v1/events" {
+			mux.ServeHTTP(w, req)
+			return
+		}
+		compressed.ServeHTTP(w, req)
+	})
 
 	cors := handlers.CORS(
 		handlers.AllowedMethods([]string{"GET", "HEAD"}),
@@ -122,7 +368,7 @@ func createServer(api *Querier, logAccess bool) *http.Server {
 		}),
 	)(zipper)
 
-	handler := http.Handler(cors)
+	handler := http.Handler(api.metrics.Instrument(cors))
 	if logAccess {
 		handler = AccessLog(handler)
 	}
@@ -132,18 +378,89 @@ func createServer(api *Querier, logAccess bool) *http.Server {
 	}
 }
 
-func reloadRepoData(api *Querier, files []string) error {
-	glog.Info("loading repodata...")
-	archs, err := loadArchIndices(flag.Args())
+// createMetricsServer starts serving metrics on a TCP address.
+func createMetricsServer(api *Querier, addr string) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	glog.Infof("serving metrics: %v", listener.Addr())
+
+	mux := httprouter.New()
+	mux.GET("/metrics", api.Metrics)
+	mux.HEAD("/metrics", api.Metrics)
+	msv := &http.Server{Handler: mux}
+	go func() {
+		if err := msv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			glog.Errorf("metrics server error: %v", err)
+		}
+	}()
+	return msv, nil
+}
+
+// reloadMu serializes reloads so that changes are computed against the data being replaced.
+var reloadMu sync.Mutex
+
+// reloadRepoData loads repodata and replaces the API's data with it. If archs is non-empty, only
+// those archs are loaded and the rest are kept from the current data.
+func reloadRepoData(api *Querier, config *loadConfig, archs ...string) (err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		api.metrics.observeReload(time.Since(start), err)
+		api.status.reloaded(time.Now().UTC(), time.Since(start), err)
+	}()
+
+	if len(archs) > 0 {
+		glog.Infof("loading repodata for %s...", strings.Join(archs, ", "))
+	} else {
+		glog.Info("loading repodata...")
+	}
+	prev := api.getData()
+	index, err := loadArchIndices(config, prev, archs...)
 	if err != nil {
 		return err
 	}
 	packages := 0
-	for _, rd := range archs.archs {
+	for _, rd := range index.archs {
 		packages += len(rd.Index())
 	}
-	glog.Infof("loaded repodata: read %d packages", packages)
-	api.SetData(archs)
+	if errs := index.Errors(); len(errs) > 0 {
+		glog.Warningf("loaded repodata with %d errors: read %d packages", len(errs), packages)
+	} else {
+		glog.Infof("loaded repodata: read %d packages", packages)
+	}
+
+	// Record changes since the last load. Nothing is recorded for the initial load.
+	var changes map[string][]packageChange
+	if len(prev.Index()) > 0 {
+		changes = diffArchIndices(prev, index)
+	}
+
+	api.SetData(index)
+
+	// The snapshot only needs to be written if some repodata or stage data changed.
+	if config.Snapshot != "" && index.IndexETag() != prev.IndexETag() {
+		if err := writeSnapshot(config.Snapshot, index); err != nil {
+			glog.Warningf("unable to write snapshot: %v", err)
+		}
+	}
+
+	now := time.Now().UTC()
+	for arch, archChanges := range changes {
+		glog.V(1).Infof("%s: %d package changes", arch, len(archChanges))
+		changes[arch] = api.changes.Add(arch, now, archChanges)
+		api.events.Publish(eventChanges, changesEvent{Arch: arch, Changes: changes[arch]})
+	}
+	api.hooks.Notify(now, changes)
+
+	if api.history != nil {
+		if err := api.history.Record(index, now); err != nil {
+			glog.Warningf("unable to record package history: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -183,6 +500,13 @@ func (r *responseCodeCapture) WriteString(s string) (int, error) {
 	return r.Write([]byte(s))
 }
 
+// Flush flushes the underlying ResponseWriter, if it is an http.Flusher.
+func (r *responseCodeCapture) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func AccessLog(next http.Handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, req *http.Request) {
 		rc := responseCodeCapture{ResponseWriter: w}
@@ -225,19 +549,19 @@ func waitForSignal(signals ...os.Signal) <-chan os.Signal {
 	return out
 }
 
-func reloadOnSignal(api *Querier, paths []string, signals ...os.Signal) {
+func reloadOnSignal(api *Querier, config *loadConfig, signals ...os.Signal) {
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, signals...)
 	for range sig {
-		if err := reloadRepoData(api, paths); err != nil {
+		if err := reloadRepoData(api, config); err != nil {
 			glog.Warningf("Error reloading repository data: %v", err)
 		}
 	}
 }
 
-func reloadOnInterval(api *Querier, paths []string, interval time.Duration) {
+func reloadOnInterval(api *Querier, config *loadConfig, interval time.Duration) {
 	for range time.Tick(interval) {
-		if err := reloadRepoData(api, paths); err != nil {
+		if err := reloadRepoData(api, config); err != nil {
 			glog.Warningf("Error reloading repository data on timer: %v", err)
 		}
 	}
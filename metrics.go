@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// metricsContentType is the content type of the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Histogram buckets, in seconds
+var (
+	requestBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	semaBuckets    = []float64{0.0001, 0.001, 0.01, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	reloadBuckets  = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+	streamBuckets  = []float64{1, 10, 60, 300, 900, 1800, 3600, 7200, 14400, 43200, 86400}
+)
+
+type metricType string
+
+const (
+	metricCounter   metricType = "counter"
+	metricGauge     metricType = "gauge"
+	metricHistogram metricType = "histogram"
+)
+
+// metricVec is a metric with zero or more labels, written in the Prometheus text format.
+type metricVec struct {
+	name    string
+	help    string
+	typ     metricType
+	labels  []string
+	buckets []float64 // Histograms only
+
+	mu     sync.Mutex
+	series map[string]*metricSeries
+}
+
+// metricSeries is the value of a metric for a single set of label values.
+type metricSeries struct {
+	values []string
+	value  float64  // Counters and gauges
+	counts []uint64 // Histograms: observations per bucket (not cumulative)
+	sum    float64
+	count  uint64
+}
+
+func newMetricVec(typ metricType, name, help string, labels ...string) *metricVec {
+	return &metricVec{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: map[string]*metricSeries{},
+	}
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *metricVec {
+	v := newMetricVec(metricHistogram, name, help, labels...)
+	v.buckets = buckets
+	return v
+}
+
+// get returns the series for a set of label values. The caller must hold v.mu.
+func (v *metricVec) get(values []string) *metricSeries {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s: got %d label values; want %d", v.name, len(values), len(v.labels)))
+	}
+	key := strings.Join(values, "\xff")
+	s := v.series[key]
+	if s == nil {
+		s = &metricSeries{values: append([]string(nil), values...)}
+		if v.typ == metricHistogram {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *metricVec) Add(delta float64, values ...string) {
+	v.mu.Lock()
+	v.get(values).value += delta
+	v.mu.Unlock()
+}
+
+func (v *metricVec) Set(value float64, values ...string) {
+	v.mu.Lock()
+	v.get(values).value = value
+	v.mu.Unlock()
+}
+
+// Reset removes every series, such as before setting a gauge's current values.
+func (v *metricVec) Reset() {
+	v.mu.Lock()
+	v.series = map[string]*metricSeries{}
+	v.mu.Unlock()
+}
+
+func (v *metricVec) Observe(value float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s := v.get(values)
+	if i := sort.SearchFloat64s(v.buckets, value); i < len(v.buckets) {
+		s.counts[i]++
+	}
+	s.sum += value
+	s.count++
+}
+
+func (v *metricVec) WriteTo(w io.Writer) (int64, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	bw := &countingWriter{w: w}
+	fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", v.name, v.help, v.name, v.typ)
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := v.series[k]
+		labels := formatLabels(v.labels, s.values)
+		if v.typ != metricHistogram {
+			fmt.Fprintf(bw, "%s%s %s\n", v.name, labels, formatFloat(s.value))
+			continue
+		}
+
+		names := append(v.labels[:len(v.labels):len(v.labels)], "le")
+		values := append(s.values[:len(s.values):len(s.values)], "")
+		var cumulative uint64
+		for i, le := range v.buckets {
+			cumulative += s.counts[i]
+			values[len(values)-1] = formatFloat(le)
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", v.name, formatLabels(names, values), cumulative)
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(bw, "%s_bucket%s %d\n", v.name, formatLabels(names, values), s.count)
+		fmt.Fprintf(bw, "%s_sum%s %s\n", v.name, labels, formatFloat(s.sum))
+		fmt.Fprintf(bw, "%s_count%s %d\n", v.name, labels, s.count)
+	}
+	return bw.n, bw.err
+}
+
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(labelEscaper.Replace(values[i]))
+		sb.WriteByte('"')
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// serverMetrics are the metrics exported by xq-api.
+type serverMetrics struct {
+	scrapeMu sync.Mutex // Held while computing and writing metrics
+
+	requests      *metricVec
+	requestTime   *metricVec
+	streamTime    *metricVec
+	responseBytes *metricVec
+
+	semaWait     *metricVec
+	semaInUse    *metricVec
+	semaCapacity *metricVec
+
+	reloads    *metricVec
+	reloadTime *metricVec
+
+	// Computed from loaded data when scraped
+	packages *metricVec
+	dataTime *metricVec
+	dataAge  *metricVec
+	loadErrs *metricVec
+	stale    *metricVec
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests: newMetricVec(metricCounter, "xqapi_http_requests_total",
+			"Total HTTP requests by route, method, and status code.",
+			"route", "method", "code"),
+		requestTime: newHistogramVec("xqapi_http_request_duration_seconds",
+			"Time taken to respond to HTTP requests by route and status code.",
+			requestBuckets, "route", "code"),
+		streamTime: newHistogramVec("xqapi_http_stream_duration_seconds",
+			"Time that streaming responses (event streams) were open for by route.",
+			streamBuckets, "route"),
+		responseBytes: newMetricVec(metricCounter, "xqapi_http_response_bytes_total",
+			"Total bytes written in HTTP responses by route.",
+			"route"),
+
+		semaWait: newHistogramVec("xqapi_query_semaphore_wait_seconds",
+			"Time spent waiting for a query slot (see -max-queries).",
+			semaBuckets),
+		semaInUse: newMetricVec(metricGauge, "xqapi_query_semaphore_in_use",
+			"Number of query slots in use."),
+		semaCapacity: newMetricVec(metricGauge, "xqapi_query_semaphore_capacity",
+			"Number of query slots (see -max-queries)."),
+
+		reloads: newMetricVec(metricCounter, "xqapi_reloads_total",
+			"Total repodata reloads by result (success or failure).",
+			"result"),
+		reloadTime: newHistogramVec("xqapi_reload_duration_seconds",
+			"Time taken to reload repodata, including failed reloads.",
+			reloadBuckets),
+
+		packages: newMetricVec(metricGauge, "xqapi_packages",
+			"Number of packages loaded by arch and repository.",
+			"arch", "repository"),
+		dataTime: newMetricVec(metricGauge, "xqapi_data_loaded_timestamp_seconds",
+			"Unix time that the loaded repodata was loaded at."),
+		dataAge: newMetricVec(metricGauge, "xqapi_data_age_seconds",
+			"Seconds since the loaded repodata was loaded."),
+		loadErrs: newMetricVec(metricGauge, "xqapi_load_errors",
+			"Number of repodata paths and files that failed to load in the last load."),
+		stale: newMetricVec(metricGauge, "xqapi_arch_stale",
+			"Whether an arch's data was kept from a previous load due to errors (1) or not (0).",
+			"arch"),
+	}
+}
+
+func (m *serverMetrics) observeReload(d time.Duration, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.reloads.Add(1, result)
+	m.reloadTime.Observe(d.Seconds())
+}
+
+// routeKey is the context key for a request's *routeInfo.
+type routeKey struct{}
+
+// routeInfo records the route that handled a request, set by a routed handler.
+type routeInfo struct {
+	route  string
+	stream bool // Set by markStream
+}
+
+// routed wraps a handler to record the route it handles for metrics.
+func routed(route string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if ri, ok := req.Context().Value(routeKey{}).(*routeInfo); ok {
+			ri.route = route
+		}
+		h(w, req, params)
+	}
+}
+
+// markStream marks a request as having a streaming response, so that its duration is recorded
+// separately from other requests. Handlers call it once they start streaming.
+func markStream(req *http.Request) {
+	if ri, ok := req.Context().Value(routeKey{}).(*routeInfo); ok {
+		ri.stream = true
+	}
+}
+
+// statusClientClosed is the status code that requests the client canceled before a response was
+// written are recorded with, as in nginx's logs. It's never sent.
+const statusClientClosed = 499
+
+// Instrument records request metrics for requests handled by next. Requests that don't match a
+// route are recorded under the route "other".
+func (m *serverMetrics) Instrument(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		ri := &routeInfo{route: "other"}
+		req = req.WithContext(context.WithValue(req.Context(), routeKey{}, ri))
+
+		rc := responseCodeCapture{ResponseWriter: w}
+		t := time.Now()
+		next.ServeHTTP(&rc, req)
+		elapsed := time.Since(t).Seconds()
+
+		if rc.Code == 0 {
+			if req.Context().Err() != nil {
+				rc.Code = statusClientClosed
+			} else {
+				rc.Code = http.StatusOK
+			}
+		}
+		code := strconv.Itoa(rc.Code)
+		m.requests.Add(1, ri.route, req.Method, code)
+		if ri.stream {
+			m.streamTime.Observe(elapsed, ri.route)
+		} else {
+			m.requestTime.Observe(elapsed, ri.route, code)
+		}
+		m.responseBytes.Add(float64(rc.Bytes), ri.route)
+	}
+}
+
+// Metrics responds with server metrics in the Prometheus text exposition format.
+func (qr *Querier) Metrics(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	m := qr.metrics
+	m.scrapeMu.Lock()
+	defer m.scrapeMu.Unlock()
+
+	index := qr.getData()
+
+	m.semaInUse.Set(float64(len(qr.sema)))
+	m.semaCapacity.Set(float64(cap(qr.sema)))
+
+	m.packages.Reset()
+	m.stale.Reset()
+	m.loadErrs.Set(float64(len(index.Errors())))
+	for _, arch := range index.Index() {
+		stale := 0.0
+		if index.Kept(arch) {
+			stale = 1
+		}
+		m.stale.Set(stale, arch)
+		for _, src := range index.Arch(arch).Sources() {
+			m.packages.Add(float64(src.Packages), arch, src.Repository)
+		}
+	}
+	if !index.loadedAt.IsZero() {
+		m.dataTime.Set(float64(index.loadedAt.UnixNano()) / 1e9)
+		m.dataAge.Set(time.Since(index.loadedAt).Seconds())
+	}
+
+	w.Header().Set("Content-Type", metricsContentType)
+	w.Header().Set("Cache-Control", "no-cache")
+	if req.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, v := range []*metricVec{
+		m.requests, m.requestTime, m.streamTime, m.responseBytes,
+		m.semaWait, m.semaInUse, m.semaCapacity,
+		m.reloads, m.reloadTime,
+		m.packages, m.dataTime, m.dataAge, m.loadErrs, m.stale,
+	} {
+		if _, err := v.WriteTo(bw); err != nil {
+			return
+		}
+	}
+	bw.Flush()
+}
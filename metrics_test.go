@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestMetricVecWriteTo(t *testing.T) {
+	counter := newMetricVec(metricCounter, "test_total", "A counter.", "route", "code")
+	counter.Add(1, "/v1/packages/:arch", "200")
+	counter.Add(2, "/v1/packages/:arch", "200")
+	counter.Add(1, `a"b`, "404")
+
+	hist := newHistogramVec("test_seconds", "A histogram.", []float64{0.1, 1}, "route")
+	hist.Observe(0.05, "x")
+	hist.Observe(0.5, "x")
+	hist.Observe(2, "x")
+
+	var sb strings.Builder
+	if _, err := counter.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := hist.WriteTo(&sb); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{route="/v1/packages/:arch",code="200"} 3
+test_total{route="a\"b",code="404"} 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="x",le="0.1"} 1
+test_seconds_bucket{route="x",le="1"} 2
+test_seconds_bucket{route="x",le="+Inf"} 3
+test_seconds_sum{route="x"} 2.55
+test_seconds_count{route="x"} 3
+`
+	if got := sb.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestInstrumentStreams(t *testing.T) {
+	m := newServerMetrics()
+	mux := httprouter.New()
+	mux.GET("/plain", routed("/plain", func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {}))
+	mux.GET("/stream", routed("/stream", func(w http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		markStream(req)
+		w.WriteHeader(http.StatusOK)
+	}))
+	h := m.Instrument(mux)
+	for _, path := range []string{"/plain", "/stream"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	var sb strings.Builder
+	m.requestTime.WriteTo(&sb)
+	m.streamTime.WriteTo(&sb)
+	out := sb.String()
+	for _, want := range []string{
+		`xqapi_http_request_duration_seconds_count{route="/plain",code="200"} 1`,
+		`xqapi_http_stream_duration_seconds_count{route="/stream"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %s:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, `xqapi_http_request_duration_seconds_count{route="/stream"`) {
+		t.Errorf("stream recorded as a request:\n%s", out)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Dewey comparison operators, as used in xbps package patterns.
+type deweyOp int
+
+const (
+	deweyLT deweyOp = iota
+	deweyLE
+	deweyEQ
+	deweyGE
+	deweyGT
+	deweyNE
+)
+
+var deweyOps = []struct {
+	s  string
+	op deweyOp
+}{
+	{"<=", deweyLE},
+	{"<", deweyLT},
+	{">=", deweyGE},
+	{">", deweyGT},
+	{"==", deweyEQ},
+	{"!=", deweyNE},
+}
+
+// parseDeweyOp parses the operator at the start of s and returns it and its length.
+func parseDeweyOp(s string) (op deweyOp, n int, ok bool) {
+	for _, t := range deweyOps {
+		if strings.HasPrefix(s, t.s) {
+			return t.op, len(t.s), true
+		}
+	}
+	return 0, 0, false
+}
+
+func (op deweyOp) test(cmp int) bool {
+	switch op {
+	case deweyLT:
+		return cmp < 0
+	case deweyLE:
+		return cmp <= 0
+	case deweyEQ:
+		return cmp == 0
+	case deweyGE:
+		return cmp >= 0
+	case deweyGT:
+		return cmp > 0
+	case deweyNE:
+		return cmp != 0
+	}
+	return false
+}
+
+type patternKind int
+
+// Pattern kinds start at 1 so that the zero value (e.g., for a pattern that failed to parse) is
+// distinct from patternName.
+const (
+	patternName  patternKind = iota + 1 // foo (any version)
+	patternExact                        // foo-1.0_1
+	patternDewey                        // foo>=1.0_1, foo>=1.0<2.0
+	patternGlob                         // foo-[0-9]*
+)
+
+func (k patternKind) String() string {
+	switch k {
+	case patternName:
+		return "name"
+	case patternExact:
+		return "exact"
+	case patternDewey:
+		return "dewey"
+	case patternGlob:
+		return "glob"
+	}
+	return fmt.Sprintf("patternKind(%d)", int(k))
+}
+
+func (k patternKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+const globChars = "*?[]"
+
+var errEmptyPattern = errors.New("pattern is empty")
+
+// Pattern is a parsed xbps package pattern, such as those found in run_depends.
+//
+// Supported patterns are bare package names (matching any version), exact package versions
+// (foo-1.0_1), relational patterns (foo>=1.0_1, foo<2, or a range such as foo>=1.0<2.0), and
+// glob patterns matched against the package version (foo-[0-9]*).
+type Pattern struct {
+	Raw string
+	// Name is the package name the pattern applies to. It may be empty for glob patterns
+	// where the name cannot be determined.
+	Name string
+	Kind patternKind
+
+	// Relational bounds (dewey patterns only)
+	op, op2   deweyOp
+	ver, ver2 string
+	upper     bool
+}
+
+// ParsePattern parses an xbps package pattern.
+func ParsePattern(s string) (*Pattern, error) {
+	if s == "" {
+		return nil, errEmptyPattern
+	}
+
+	p := &Pattern{Raw: s}
+	if sep := strings.IndexAny(s, "<>"); sep != -1 {
+		if err := p.parseDewey(sep); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	if glob := strings.IndexAny(s, globChars); glob != -1 {
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob pattern %q: %w", s, err)
+		}
+		// Only take a name from the pattern if the glob clearly follows the name (e.g.,
+		// foo-[0-9]* or foo-1.*). Otherwise, it could match more than one name.
+		p.Kind = patternGlob
+		if sep := strings.LastIndexByte(s[:glob], '-'); sep > 0 {
+			if vsn := s[sep+1:]; isDigit(vsn[0]) || strings.HasPrefix(vsn, "[0-9]") {
+				p.Name = s[:sep]
+			}
+		}
+		return p, nil
+	}
+
+	if name, _, _, err := ParseVersionedName(s); err == nil {
+		p.Kind, p.Name = patternExact, name
+		return p, nil
+	}
+
+	p.Kind, p.Name = patternName, s
+	return p, nil
+}
+
+func (p *Pattern) parseDewey(sep int) error {
+	s := p.Raw
+	if sep == 0 {
+		return fmt.Errorf("invalid pattern %q: no package name", s)
+	}
+	p.Kind, p.Name = patternDewey, s[:sep]
+
+	op, n, ok := parseDeweyOp(s[sep:])
+	if !ok {
+		return fmt.Errorf("invalid pattern %q: unrecognized operator", s)
+	}
+	p.op, p.ver = op, s[sep+n:]
+
+	// As with xbps, a lower bound may be followed by an upper bound.
+	if op == deweyGT || op == deweyGE {
+		if sep2 := strings.IndexByte(p.ver, '<'); sep2 != -1 {
+			op2, n, ok := parseDeweyOp(p.ver[sep2:])
+			if !ok {
+				return fmt.Errorf("invalid pattern %q: unrecognized operator", s)
+			}
+			p.op2, p.ver2, p.upper = op2, p.ver[sep2+n:], true
+			p.ver = p.ver[:sep2]
+		}
+	}
+
+	if p.ver == "" || (p.upper && p.ver2 == "") {
+		return fmt.Errorf("invalid pattern %q: no version", s)
+	}
+	return nil
+}
+
+// Match returns whether the pattern matches a package version (i.e., a pkgver such as
+// foo-1.0_1).
+func (p *Pattern) Match(pkgver string) bool {
+	if p.Raw == pkgver {
+		return true
+	}
+
+	switch p.Kind {
+	case patternName:
+		name, _, _, err := ParseVersionedName(pkgver)
+		return err == nil && name == p.Name
+	case patternDewey:
+		sep := strings.LastIndexByte(pkgver, '-')
+		if sep == -1 || pkgver[:sep] != p.Name {
+			return false
+		}
+		version := pkgver[sep+1:]
+		if p.upper && !p.op2.test(CompareVersions(version, p.ver2)) {
+			return false
+		}
+		return p.op.test(CompareVersions(version, p.ver))
+	case patternGlob:
+		ok, _ := path.Match(p.Raw, pkgver)
+		return ok
+	}
+	return false
+}
+
+// MatchPackage returns whether the pattern matches the given package.
+func (p *Pattern) MatchPackage(pkg *packageData) bool {
+	return pkg != nil && p.Match(pkg.PackageVersion)
+}
+
+func (p *Pattern) String() string {
+	return p.Raw
+}
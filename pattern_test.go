@@ -0,0 +1,76 @@
+package main
+
+import "testing"
+
+func TestParsePattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		kind    patternKind
+	}{
+		{"glibc>=2.28_1", "glibc", patternDewey},
+		{"gtk+3>=3.24.0_1<4", "gtk+3", patternDewey},
+		{"libfoo<2", "libfoo", patternDewey},
+		{"python3-setuptools-40.6.3_1", "python3-setuptools", patternExact},
+		{"perl-URI-[0-9]*", "perl-URI", patternGlob},
+		{"font-*", "", patternGlob},
+		{"foo-1.*", "foo", patternGlob},
+		{"bash", "bash", patternName},
+	}
+
+	for _, c := range cases {
+		pat, err := ParsePattern(c.pattern)
+		if err != nil {
+			t.Errorf("ParsePattern(%q): %v", c.pattern, err)
+			continue
+		}
+		if pat.Name != c.name {
+			t.Errorf("ParsePattern(%q).Name = %q; want %q", c.pattern, pat.Name, c.name)
+		}
+		if pat.Kind != c.kind {
+			t.Errorf("ParsePattern(%q).Kind = %v; want %v", c.pattern, pat.Kind, c.kind)
+		}
+	}
+
+	for _, bad := range []string{"", ">=1.0", "foo>=", "foo>=1.0<", "foo-[0-9"} {
+		if _, err := ParsePattern(bad); err == nil {
+			t.Errorf("ParsePattern(%q) = nil; want error", bad)
+		}
+	}
+}
+
+func TestPatternMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		pkgver  string
+		want    bool
+	}{
+		{"glibc>=2.28_1", "glibc-2.28_1", true},
+		{"glibc>=2.28_1", "glibc-2.30_1", true},
+		{"glibc>=2.28_1", "glibc-2.27_3", false},
+		{"glibc>=2.28_1", "glibc-devel-2.30_1", false},
+		{"foo>2", "foo-2_1", true},
+		{"foo>2_1", "foo-2_1", false},
+		{"foo<2", "foo-1.9_1", true},
+		{"foo<2", "foo-2.0rc1_1", true},
+		{"foo<=2_1", "foo-2_1", true},
+		{"foo>=1.0<2.0", "foo-1.5_1", true},
+		{"foo>=1.0<2.0", "foo-2.0_1", false},
+		{"foo-1.0_1", "foo-1.0_1", true},
+		{"foo-1.0_1", "foo-1.0_2", false},
+		{"foo-[0-9]*", "foo-1.0_1", true},
+		{"foo-[0-9]*", "foo-bar-1.0_1", false},
+		{"foo", "foo-1.0_1", true},
+		{"foo", "foo-bar-1.0_1", false},
+	}
+
+	for _, c := range cases {
+		pat, err := ParsePattern(c.pattern)
+		if err != nil {
+			t.Fatalf("ParsePattern(%q): %v", c.pattern, err)
+		}
+		if got := pat.Match(c.pkgver); got != c.want {
+			t.Errorf("%q.Match(%q) = %t; want %t", c.pattern, c.pkgver, got, c.want)
+		}
+	}
+}
@@ -3,48 +3,145 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"encoding/xml"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/julienschmidt/httprouter"
 )
 
+// shortEntry is a subset of a package's fields, used when responding with lists of packages.
+type shortEntry struct {
+	Name         string `json:"name"`
+	Version      string `json:"version"`
+	Revision     int    `json:"revision"`
+	FilenameSize int64  `json:"filename_size"`
+	Repository   string `json:"repository,omitempty"`
+	ShortDesc    string `json:"short_desc,omitempty"`
+}
+
+func newShortEntry(p *packageData) shortEntry {
+	return shortEntry{
+		Name:         p.Name,
+		Version:      p.Version,
+		Revision:     p.Revision,
+		FilenameSize: p.FilenameSize,
+		Repository:   p.Repository,
+		ShortDesc:    p.ShortDesc,
+	}
+}
+
 type Querier struct {
-	data atomic.Value  // Handlers / SetData
-	sema chan struct{} // Limited handlers
+	data     atomic.Value  // Handlers / SetData
+	sema     chan struct{} // Limited handlers
+	semaWait time.Duration // How long to wait for sema (unbounded if <= 0)
+	limiter  *rateLimiter  // Per-client request limits (optional)
+	changes  *changeLog    // Changes between reloads
+	history  *historyStore // Persistent package history (optional)
+	hooks    *Webhooks     // Notified of changes (optional)
+	events   *eventBroker  // Reload and change events
+	metrics  *serverMetrics
+	status   *serverStatus
 }
 
-func NewQuerier(maxProcs int) *Querier {
+func NewQuerier(maxProcs, maxChanges, maxEvents int) *Querier {
 	if maxProcs < 1 {
 		maxProcs = 1
 	}
 
 	querier := &Querier{
-		sema: make(chan struct{}, maxProcs),
+		sema:    make(chan struct{}, maxProcs),
+		changes: newChangeLog(maxChanges),
+		events:  newEventBroker(maxEvents),
+		metrics: newServerMetrics(),
+		status:  newServerStatus(),
 	}
 	querier.SetData(new(archIndex))
 	return querier
 }
 
 func (qr *Querier) SetData(index *archIndex) {
-	if index != nil {
-		qr.data.Store(index)
+	if index == nil {
+		return
+	}
+	prev, _ := qr.data.Load().(*archIndex)
+	qr.data.Store(index)
+	qr.status.measure(index)
+	if !index.loadedAt.IsZero() {
+		qr.events.publishReload(prev, index)
+	}
+}
+
+// SetHistory sets the history store used to serve package history. If h is nil, package
+// history is not served.
+func (qr *Querier) SetHistory(h *historyStore) {
+	qr.history = h
+}
+
+// SetWebhooks sets the webhooks notified of package changes when repodata is reloaded.
+func (qr *Querier) SetWebhooks(hooks *Webhooks) {
+	qr.hooks = hooks
+}
+
+// SetQueryWait sets how long a request may wait for a query slot before it's answered with 503
+// Service Unavailable. If wait <= 0, requests wait until a slot is free or the client goes away.
+func (qr *Querier) SetQueryWait(wait time.Duration) {
+	qr.semaWait = wait
+}
+
+// acquire waits for a query slot and returns a function to release it. If no slot is free before
+// the query wait (see SetQueryWait) passes, it responds with 503 Service Unavailable and returns
+// false. If the request is canceled while waiting, it returns false without responding.
+func (qr *Querier) acquire(w http.ResponseWriter, req *http.Request) (release func(), ok bool) {
+	t := time.Now()
+	defer func() { qr.metrics.semaWait.Observe(time.Since(t).Seconds()) }()
+
+	// Try to take a slot without waiting first.
+	select {
+	case qr.sema <- struct{}{}:
+		return func() { <-qr.sema }, true
+	default:
+	}
+
+	var timeout <-chan time.Time
+	if qr.semaWait > 0 {
+		timer := time.NewTimer(qr.semaWait)
+		defer timer.Stop()
+		timeout = timer.C
 	}
+
+	select {
+	case qr.sema <- struct{}{}:
+		return func() { <-qr.sema }, true
+	case <-timeout:
+		qr.retryLater(w, http.StatusServiceUnavailable, qr.semaWait, "too many queries")
+	case <-req.Context().Done():
+		glog.V(1).Infof("request canceled waiting for a query slot: %v", req.Context().Err())
+	}
+	return nil, false
 }
 
 func (qr *Querier) getData() *archIndex {
 	return qr.data.Load().(*archIndex)
 }
 
+// setDefaultCacheControl sets the default Cache-Control of responses if a handler hasn't set its
+// own. Currently just request browsers cache all responses for five minutes at most. It doesn't
+// matter if the cached value is a few minutes old when dealing with search-able repodata from the
+// browser.
+func setDefaultCacheControl(h http.Header) {
+	if h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", "public, max-age=300")
+	}
+}
+
 func (qr *Querier) reply(w http.ResponseWriter, code int, val interface{}) {
-	// Currently just request browsers cache all responses for five minutes at most. It doesn't
-	// matter if the cached value is a few minutes old when dealing with search-able repodata
-	// from the browser.
-	w.Header().Set("Cache-Control", "public, max-age=300")
+	setDefaultCacheControl(w.Header())
 	w.Header().Set("Content-Type", "application/json")
 
 	// Write an empty response
@@ -64,11 +161,16 @@ func (qr *Querier) reply(w http.ResponseWriter, code int, val interface{}) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	qr.writeBody(w, code, "application/json", buf.Bytes())
+}
+
+// writeBody writes a response body of the given content type, including its length.
+func (qr *Querier) writeBody(w http.ResponseWriter, code int, contentType string, body []byte) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
 	w.WriteHeader(code)
 
-	_, err := buf.WriteTo(w)
+	_, err := w.Write(body)
 	switch err.(type) {
 	case nil:
 	case net.Error:
@@ -96,6 +198,15 @@ func (qr *Querier) NotFound(w http.ResponseWriter, _ *http.Request) {
 	qr.reply(w, http.StatusNotFound, struct{}{})
 }
 
+func (qr *Querier) BadRequest(w http.ResponseWriter, _ *http.Request, msg string) {
+	response := struct {
+		Error string `json:"error"`
+	}{
+		Error: msg,
+	}
+	qr.reply(w, http.StatusBadRequest, response)
+}
+
 func (qr *Querier) Archs(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	root := qr.getData()
 	if qr.skipIfMatch(w, req, root.IndexETag()) {
@@ -113,19 +224,156 @@ func (qr *Querier) Archs(w http.ResponseWriter, req *http.Request, params httpro
 		QueryPath    string `json:"query_path"`
 	}
 
-	index := root.Index()
+	qr.replyCached(w, req, root, "archs "+root.IndexETag(), func() interface{} {
+		return struct {
+			Data []string `json:"data"`
+		}{
+			Data: root.Archs(),
+		}
+	})
+}
+
+func (qr *Querier) PackageList(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	arch := params.ByName("arch")
+	root := qr.getData()
+	rd := root.Arch(arch)
+	if rd == nil {
+		qr.NotFound(w, req)
+		return
+	}
+
+	if qr.skipIfMatch(w, req, rd.ETag()) {
+		return
+	}
+
+	repo := req.FormValue("repo")
+	sub := rd.Index()
+	if repo != "" {
+		if sub = rd.RepoIndex(repo); sub == nil {
+			qr.NotFound(w, req)
+			return
+		}
+	}
+
+	if req.Method == "HEAD" {
+		qr.reply(w, http.StatusOK, nil)
+		return
+	}
+
+	key := "packages " + arch + " " + repo + " " + rd.ETag()
+	qr.replyCached(w, req, root, key, func() interface{} {
+		names := rd.NameIndex()
+		if repo != "" {
+			names = make([]string, len(sub))
+			for i, p := range sub {
+				names[i] = p.Name
+			}
+		}
+		return struct {
+			Data []string `json:"data"`
+		}{
+			Data: names,
+		}
+	})
+}
+
+func (qr *Querier) Package(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	arch := params.ByName("arch")
+	pkgname := params.ByName("package")
+
+	root := qr.getData()
+	rd := root.Arch(arch)
+	if rd == nil {
+		qr.NotFound(w, req)
+		return
+	}
+
+	pkg := rd.Package(pkgname)
+	if pkg == nil {
+		qr.NotFound(w, req)
+		return
+	}
+
+	// Resolved dependencies depend on other packages as well, so use the repodata's ETag
+	// for them.
+	resolve, _ := strconv.ParseBool(req.FormValue("resolve"))
+	staged := root.StagedPackage(arch, pkg)
+	etag := rd.CandidatesETag(pkgname)
+	if resolve {
+		etag = rd.ETag()
+	}
+	if staged != nil {
+		etag = joinETags(etag, staged.ETag)
+	}
+
+	if qr.skipIfMatch(w, req, etag) {
+		return
+	}
+
+	if req.Method == "HEAD" {
+		qr.reply(w, http.StatusOK, nil)
+		return
+	}
+
+	type candidateEntry struct {
+		Repository     string   `json:"repository"`
+		Version        string   `json:"version"`
+		Revision       int      `json:"revision"`
+		BuildDate      *timeVal `json:"build_date,omitempty"`
+		FilenameSHA256 string   `json:"filename_sha256,omitempty"`
+		FilenameSize   int64    `json:"filename_size,omitempty"`
+		Preferred      bool     `json:"preferred"`
+	}
+
+	type packageEntry struct {
+		*packageData
+		Candidates      []candidateEntry `json:"candidates"`
+		Staged          *shortEntry      `json:"staged,omitempty"`
+		ResolvedDepends []resolvedDepend `json:"resolved_depends,omitempty"`
+	}
+
+	cands := rd.Candidates(pkgname)
 	response := struct {
-		Data []string `json:"data"`
+		Data packageEntry `json:"data"`
 	}{
-		Data: index,
+		Data: packageEntry{
+			packageData: pkg,
+			Candidates:  make([]candidateEntry, len(cands)),
+		},
+	}
+
+	for i, p := range cands {
+		cand := candidateEntry{
+			Repository:     p.Repository,
+			Version:        p.Version,
+			Revision:       p.Revision,
+			FilenameSHA256: p.FilenameSHA256,
+			FilenameSize:   p.FilenameSize,
+			Preferred:      p == pkg,
+		}
+		if !time.Time(p.BuildDate).IsZero() {
+			cand.BuildDate = &p.BuildDate
+		}
+		response.Data.Candidates[i] = cand
+	}
+
+	if staged != nil {
+		entry := newShortEntry(staged)
+		response.Data.Staged = &entry
+	}
+
+	if resolve {
+		response.Data.ResolvedDepends = rd.ResolveDepends(pkg)
 	}
 
 	qr.reply(w, http.StatusOK, response)
 }
 
-func (qr *Querier) PackageList(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+func (qr *Querier) Query(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	query := strings.ToLower(req.FormValue("q"))
 	arch := params.ByName("arch")
-	rd := qr.getData().Arch(arch)
+	root := qr.getData()
+	rd := root.Arch(arch)
 	if rd == nil {
 		qr.NotFound(w, req)
 		return
@@ -140,32 +388,135 @@ func (qr *Querier) PackageList(w http.ResponseWriter, req *http.Request, params
 		return
 	}
 
+	sub := rd.Index()
+	if repo := req.FormValue("repo"); repo != "" {
+		if sub = rd.RepoIndex(repo); sub == nil {
+			qr.NotFound(w, req)
+			return
+		}
+	}
+
+	shortEntries := func(sub packageIndex) interface{} {
+		response := struct {
+			Data []shortEntry `json:"data"`
+		}{
+			Data: make([]shortEntry, len(sub)),
+		}
+		for i, p := range sub {
+			response.Data[i] = newShortEntry(p)
+		}
+		return response
+	}
+
+	// Without a query, every request for the same repo gets the same response.
+	if query == "" {
+		key := "query " + arch + " " + req.FormValue("repo") + " " + rd.ETag()
+		qr.replyCached(w, req, root, key, func() interface{} { return shortEntries(sub) })
+		return
+	}
+
+	release, ok := qr.acquire(w, req)
+	if !ok {
+		return
+	}
+	defer release()
+	sub = sub.Filter(func(p *packageData) bool {
+		return p.matchesQuery(query)
+	})
+	qr.reply(w, http.StatusOK, shortEntries(sub))
+}
+
+func (qr *Querier) Compare(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	a, b := req.FormValue("a"), req.FormValue("b")
+	if a == "" || b == "" {
+		qr.BadRequest(w, req, "both a and b versions are required")
+		return
+	}
+
+	if req.Method == "HEAD" {
+		qr.reply(w, http.StatusOK, nil)
+		return
+	}
+
+	type compareResult struct {
+		A      string `json:"a"`
+		B      string `json:"b"`
+		Result int    `json:"result"`
+	}
+
 	response := struct {
-		Data []string `json:"data"`
+		Data compareResult `json:"data"`
 	}{
-		Data: rd.NameIndex(),
+		Data: compareResult{
+			A:      a,
+			B:      b,
+			Result: CompareVersions(a, b),
+		},
 	}
 
 	qr.reply(w, http.StatusOK, response)
 }
 
-func (qr *Querier) Package(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+func (qr *Querier) RevDeps(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	arch := params.ByName("arch")
 	pkgname := params.ByName("package")
 
 	rd := qr.getData().Arch(arch)
-	if rd == nil {
+	if rd == nil || rd.Package(pkgname) == nil {
 		qr.NotFound(w, req)
 		return
 	}
 
-	pkg := rd.Package(pkgname)
-	if pkg == nil {
+	if qr.skipIfMatch(w, req, rd.ETag()) {
+		return
+	}
+
+	if req.Method == "HEAD" {
+		qr.reply(w, http.StatusOK, nil)
+		return
+	}
+
+	type revdepEntry struct {
+		shortEntry
+		Pattern string `json:"pattern"`
+	}
+
+	revdeps := rd.RevDeps(pkgname)
+	response := struct {
+		Data []revdepEntry `json:"data"`
+	}{
+		Data: make([]revdepEntry, len(revdeps)),
+	}
+
+	for i, dep := range revdeps {
+		response.Data[i] = revdepEntry{
+			shortEntry: newShortEntry(dep.Package),
+			Pattern:    dep.Pattern,
+		}
+	}
+
+	qr.reply(w, http.StatusOK, response)
+}
+
+func (qr *Querier) Closure(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	arch := params.ByName("arch")
+	rd := qr.getData().Arch(arch)
+	if rd == nil {
 		qr.NotFound(w, req)
 		return
 	}
 
-	if qr.skipIfMatch(w, req, pkg.ETag) {
+	if err := req.ParseForm(); err != nil {
+		qr.BadRequest(w, req, err.Error())
+		return
+	}
+	names := req.Form["pkg"]
+	if len(names) == 0 {
+		qr.BadRequest(w, req, "at least one pkg is required")
+		return
+	}
+
+	if qr.skipIfMatch(w, req, rd.ETag()) {
 		return
 	}
 
@@ -174,19 +525,98 @@ func (qr *Querier) Package(w http.ResponseWriter, req *http.Request, params http
 		return
 	}
 
+	release, ok := qr.acquire(w, req)
+	if !ok {
+		return
+	}
+	defer release()
+	entries, unsatisfied := rd.Closure(names)
+
+	type closurePackage struct {
+		shortEntry
+		InstalledSize int64 `json:"installed_size"`
+		Depth         int   `json:"depth"`
+	}
+
+	type closureResult struct {
+		FilenameSize  int64               `json:"filename_size"`
+		InstalledSize int64               `json:"installed_size"`
+		Packages      []closurePackage    `json:"packages"`
+		Unsatisfied   []unsatisfiedDepend `json:"unsatisfied,omitempty"`
+	}
+
 	response := struct {
-		Data *packageData `json:"data"`
+		Data closureResult `json:"data"`
 	}{
-		Data: pkg,
+		Data: closureResult{
+			Packages:    make([]closurePackage, len(entries)),
+			Unsatisfied: unsatisfied,
+		},
+	}
+
+	for i, e := range entries {
+		response.Data.FilenameSize += e.Package.FilenameSize
+		response.Data.InstalledSize += e.Package.InstalledSize
+		response.Data.Packages[i] = closurePackage{
+			shortEntry:    newShortEntry(e.Package),
+			InstalledSize: e.Package.InstalledSize,
+			Depth:         e.Depth,
+		}
 	}
 
 	qr.reply(w, http.StatusOK, response)
 }
 
-func (qr *Querier) Query(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	query := strings.ToLower(req.FormValue("q"))
+func (qr *Querier) Shlibs(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	arch := params.ByName("arch")
+	soname := params.ByName("soname")
+
 	rd := qr.getData().Arch(arch)
+	providers, requirers := rd.ShlibProviders(soname), rd.ShlibRequirers(soname)
+	if len(providers) == 0 && len(requirers) == 0 {
+		qr.NotFound(w, req)
+		return
+	}
+
+	if qr.skipIfMatch(w, req, rd.ETag()) {
+		return
+	}
+
+	if req.Method == "HEAD" {
+		qr.reply(w, http.StatusOK, nil)
+		return
+	}
+
+	type shlibResult struct {
+		Soname     string       `json:"soname"`
+		ProvidedBy []shortEntry `json:"provided_by"`
+		RequiredBy []shortEntry `json:"required_by"`
+	}
+
+	response := struct {
+		Data shlibResult `json:"data"`
+	}{
+		Data: shlibResult{
+			Soname:     soname,
+			ProvidedBy: make([]shortEntry, len(providers)),
+			RequiredBy: make([]shortEntry, len(requirers)),
+		},
+	}
+
+	for i, p := range providers {
+		response.Data.ProvidedBy[i] = newShortEntry(p)
+	}
+	for i, p := range requirers {
+		response.Data.RequiredBy[i] = newShortEntry(p)
+	}
+
+	qr.reply(w, http.StatusOK, response)
+}
+
+func (qr *Querier) Repos(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	arch := params.ByName("arch")
+	root := qr.getData()
+	rd := root.Arch(arch)
 	if rd == nil {
 		qr.NotFound(w, req)
 		return
@@ -201,41 +631,229 @@ func (qr *Querier) Query(w http.ResponseWriter, req *http.Request, params httpro
 		return
 	}
 
-	qr.sema <- struct{}{}
-	defer func() { <-qr.sema }()
-	sub := rd.Index()
-	if query != "" {
-		sub = sub.Filter(func(p *packageData) bool {
-			return strings.Contains(p.SearchPackageVersion, query) ||
-				strings.Contains(p.SearchShortDesc, query)
-		})
+	qr.replyCached(w, req, root, "repos "+arch+" "+rd.ETag(), func() interface{} {
+		return struct {
+			Data []repoSource `json:"data"`
+		}{
+			Data: rd.Sources(),
+		}
+	})
+}
+
+func (qr *Querier) Staged(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	arch := params.ByName("arch")
+	root := qr.getData()
+	rd, staged := root.Arch(arch), root.Staged(arch)
+	if rd == nil && staged == nil {
+		qr.NotFound(w, req)
+		return
 	}
 
-	type shortEntry struct {
-		Name         string `json:"name"`
-		Version      string `json:"version"`
-		Revision     int    `json:"revision"`
-		FilenameSize int64  `json:"filename_size"`
-		Repository   string `json:"repository,omitempty"`
-		ShortDesc    string `json:"short_desc,omitempty"`
+	etag := joinETags(rd.ETag(), staged.ETag())
+	if qr.skipIfMatch(w, req, etag) {
+		return
+	}
+
+	if req.Method == "HEAD" {
+		qr.reply(w, http.StatusOK, nil)
+		return
+	}
+
+	type stagedEntry struct {
+		shortEntry
+		CurrentVersion  string `json:"current_version,omitempty"`
+		CurrentRevision int    `json:"current_revision,omitempty"`
+	}
+
+	qr.replyCached(w, req, root, "staged "+arch+" "+etag, func() interface{} {
+		updates := root.StagedUpdates(arch)
+		response := struct {
+			Data []stagedEntry `json:"data"`
+		}{
+			Data: make([]stagedEntry, len(updates)),
+		}
+
+		for i, u := range updates {
+			response.Data[i] = stagedEntry{shortEntry: newShortEntry(u.Package)}
+			if u.Current != nil {
+				response.Data[i].CurrentVersion = u.Current.Version
+				response.Data[i].CurrentRevision = u.Current.Revision
+			}
+		}
+		return response
+	})
+}
+
+func (qr *Querier) Changes(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	arch := params.ByName("arch")
+	etag := qr.changes.ETag(arch)
+	if etag == "" && qr.getData().Arch(arch) == nil {
+		qr.NotFound(w, req)
+		return
+	}
+
+	var since uint64
+	if s := req.FormValue("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			qr.BadRequest(w, req, "since must be a change id")
+			return
+		}
+	}
+
+	if qr.skipIfMatch(w, req, etag) {
+		return
+	}
+
+	if req.Method == "HEAD" {
+		qr.reply(w, http.StatusOK, nil)
+		return
+	}
+
+	changes := qr.changes.Since(arch, since)
+	if changes == nil {
+		changes = []packageChange{}
 	}
 
 	response := struct {
-		Data []shortEntry `json:"data"`
+		Data []packageChange `json:"data"`
 	}{
-		Data: make([]shortEntry, len(sub)),
+		Data: changes,
 	}
 
-	for i, p := range sub {
-		response.Data[i] = shortEntry{
-			Name:         p.Name,
-			Version:      p.Version,
-			Revision:     p.Revision,
-			FilenameSize: p.FilenameSize,
-			Repository:   p.Repository,
-			ShortDesc:    p.ShortDesc,
-		}
+	qr.reply(w, http.StatusOK, response)
+}
+
+func (qr *Querier) Feed(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	arch := params.ByName("arch")
+	etag := qr.changes.ETag(arch)
+	if etag == "" && qr.getData().Arch(arch) == nil {
+		qr.NotFound(w, req)
+		return
+	}
+
+	if qr.skipIfMatch(w, req, etag) {
+		return
+	}
+
+	filter := feedFilter{
+		Repository: req.FormValue("repo"),
+		Maintainer: req.FormValue("maintainer"),
+		Package:    req.FormValue("package"),
+	}
+	feed := buildFeed(req, arch, qr.changes.Since(arch, 0), filter)
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	if err := xml.NewEncoder(&buf).Encode(feed); err != nil {
+		glog.Warningf("unable to encode feed: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// HEAD requests get the same reply as GET, so that any compression of the body is reflected in
+	// their headers. The body itself is discarded by the server.
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	qr.writeBody(w, http.StatusOK, atomContentType, buf.Bytes())
+}
+
+func (qr *Querier) PackageHistory(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if qr.history == nil {
+		qr.NotFound(w, req)
+		return
+	}
+
+	arch := params.ByName("arch")
+	pkgname := params.ByName("package")
+	history := qr.history.Package(arch, pkgname)
+	if len(history) == 0 {
+		qr.NotFound(w, req)
+		return
+	}
+
+	if req.Method == "HEAD" {
+		qr.reply(w, http.StatusOK, nil)
+		return
+	}
+
+	response := struct {
+		Data []historyEntry `json:"data"`
+	}{
+		Data: history,
 	}
 
 	qr.reply(w, http.StatusOK, response)
 }
+
+// Events streams reload and change events as server-sent events. Streams may be resumed by
+// passing the ID of the last event received in the Last-Event-ID header or last_event_id query
+// parameter.
+func (qr *Querier) Events(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		glog.Warning("unable to stream events: response writer is not an http.Flusher")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var lastID uint64
+	if s := req.Header.Get("Last-Event-ID"); s != "" {
+		lastID, _ = strconv.ParseUint(s, 10, 64)
+	} else if s := req.FormValue("last_event_id"); s != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(s, 10, 64); err != nil {
+			qr.BadRequest(w, req, "last_event_id must be an event id")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	if req.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	sub, backlog, missed := qr.events.Subscribe(lastID)
+	defer qr.events.Unsubscribe(sub)
+
+	markStream(req)
+	w.WriteHeader(http.StatusOK)
+	if missed {
+		// Clients should refetch anything they rely on. The reset event's ID is the ID
+		// preceding the backlog, or 0 (to start over) if there is no backlog.
+		reset := event{Type: eventReset, Data: []byte("{}")}
+		if len(backlog) > 0 {
+			reset.ID = backlog[0].ID - 1
+		}
+		backlog = append([]event{reset}, backlog...)
+	}
+	for _, ev := range backlog {
+		if writeEvent(w, ev) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case ev, ok := <-sub:
+			if !ok {
+				return
+			}
+			if writeEvent(w, ev) != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": keep-alive\n\n")); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// testQuery calls h with a GET request for target and returns the response. If the response
+// status is 200, its body is decoded into out.
+func testQuery(t *testing.T, h httprouter.Handle, target string, params httprouter.Params, out interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", target, nil), params)
+	if w.Code == 200 && out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("GET %s: unable to decode response: %v", target, err)
+		}
+	}
+	return w
+}
+
+func TestRevDepsHandler(t *testing.T) {
+	rd := testRepoPackages(t, map[string][]*packageData{
+		"current": {
+			{PackageVersion: "foo-1.2_1"},
+			{PackageVersion: "bar-1.0_1", RunDepends: []string{"foo>=1"}},
+		},
+	})
+	qr := NewQuerier(1, 1, 1)
+	qr.SetData(&archIndex{archs: map[string]*RepoData{"x86_64": rd}})
+
+	var response struct {
+		Data []struct {
+			Name    string `json:"name"`
+			Pattern string `json:"pattern"`
+		} `json:"data"`
+	}
+
+	cases := []struct {
+		arch, pkg string
+		code      int
+		want      []string
+	}{
+		{"x86_64", "foo", 200, []string{"bar foo>=1"}},
+		{"x86_64", "bar", 200, []string{}},
+		{"x86_64", "missing", 404, nil},
+		{"i686", "foo", 404, nil},
+	}
+
+	for _, c := range cases {
+		target := "/v1/revdeps/" + c.arch + "/" + c.pkg
+		params := httprouter.Params{{Key: "arch", Value: c.arch}, {Key: "package", Value: c.pkg}}
+		response.Data = nil
+		w := testQuery(t, qr.RevDeps, target, params, &response)
+		if w.Code != c.code {
+			t.Errorf("GET %s: status = %d; want %d", target, w.Code, c.code)
+			continue
+		}
+		if c.code != 200 {
+			continue
+		}
+		if response.Data == nil {
+			t.Errorf("GET %s: data is %s; want an array", target, w.Body)
+		}
+		got := []string{}
+		for _, d := range response.Data {
+			got = append(got, d.Name+" "+d.Pattern)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("GET %s = %v; want %v", target, got, c.want)
+		}
+	}
+}
+
+func TestClosureHandler(t *testing.T) {
+	rd := testRepoPackages(t, map[string][]*packageData{
+		"current": {
+			{PackageVersion: "app-1.0_1", RunDepends: []string{"lib>=1"}, FilenameSize: 1000, InstalledSize: 4000},
+			{PackageVersion: "lib-1.0_1", RunDepends: []string{"app>=1", "missing>=1"}, FilenameSize: 200, InstalledSize: 500},
+			{PackageVersion: "other-1.0_1", FilenameSize: 30, InstalledSize: 60},
+		},
+	})
+	qr := NewQuerier(1, 1, 1)
+	qr.SetData(&archIndex{archs: map[string]*RepoData{"x86_64": rd}})
+
+	type closureResult struct {
+		FilenameSize  int64 `json:"filename_size"`
+		InstalledSize int64 `json:"installed_size"`
+		Packages      []struct {
+			Name          string `json:"name"`
+			InstalledSize int64  `json:"installed_size"`
+			Depth         int    `json:"depth"`
+		} `json:"packages"`
+		Unsatisfied []unsatisfiedDepend `json:"unsatisfied"`
+	}
+
+	cases := []struct {
+		target        string
+		arch          string
+		code          int
+		filenameSize  int64
+		installedSize int64
+		packages      []string // name:depth
+		unsatisfied   []unsatisfiedDepend
+	}{
+		{
+			target:        "/v1/closure/x86_64?pkg=app",
+			arch:          "x86_64",
+			code:          200,
+			filenameSize:  1200,
+			installedSize: 4500,
+			packages:      []string{"app:0", "lib:1"},
+			unsatisfied:   []unsatisfiedDepend{{Pattern: "missing>=1", RequiredBy: "lib"}},
+		},
+		{
+			target:        "/v1/closure/x86_64?pkg=other&pkg=app",
+			arch:          "x86_64",
+			code:          200,
+			filenameSize:  1230,
+			installedSize: 4560,
+			packages:      []string{"app:0", "other:0", "lib:1"},
+			unsatisfied:   []unsatisfiedDepend{{Pattern: "missing>=1", RequiredBy: "lib"}},
+		},
+		{
+			target:      "/v1/closure/x86_64?pkg=nope",
+			arch:        "x86_64",
+			code:        200,
+			unsatisfied: []unsatisfiedDepend{{Pattern: "nope"}},
+		},
+		{target: "/v1/closure/x86_64", arch: "x86_64", code: 400},
+		{target: "/v1/closure/i686?pkg=app", arch: "i686", code: 404},
+	}
+
+	for _, c := range cases {
+		var response struct {
+			Data closureResult `json:"data"`
+		}
+		w := testQuery(t, qr.Closure, c.target, httprouter.Params{{Key: "arch", Value: c.arch}}, &response)
+		if w.Code != c.code {
+			t.Errorf("GET %s: status = %d; want %d", c.target, w.Code, c.code)
+			continue
+		}
+		if c.code != 200 {
+			continue
+		}
+
+		got := response.Data
+		if got.FilenameSize != c.filenameSize || got.InstalledSize != c.installedSize {
+			t.Errorf("GET %s: sizes = %d, %d; want %d, %d", c.target,
+				got.FilenameSize, got.InstalledSize, c.filenameSize, c.installedSize)
+		}
+		var packages []string
+		for _, p := range got.Packages {
+			packages = append(packages, p.Name+":"+strconv.Itoa(p.Depth))
+		}
+		if !reflect.DeepEqual(packages, c.packages) {
+			t.Errorf("GET %s: packages = %v; want %v", c.target, packages, c.packages)
+		}
+		if !reflect.DeepEqual(got.Unsatisfied, c.unsatisfied) {
+			t.Errorf("GET %s: unsatisfied = %v; want %v", c.target, got.Unsatisfied, c.unsatisfied)
+		}
+	}
+}
+
+func TestPackageCandidates(t *testing.T) {
+	rd := testRepoPackages(t, map[string][]*packageData{
+		"current": {
+			{PackageVersion: "libfoo-1_1", ShlibProvides: []string{"libfoo.so.1"}},
+			{PackageVersion: "tie-1.0_1"},
+			{PackageVersion: "older-2.0_1"},
+		},
+		"nonfree": {
+			{PackageVersion: "libfoo-2_1", ShlibProvides: []string{"libfoo.so.2"}},
+			{PackageVersion: "tie-1.0_1"},
+			{PackageVersion: "older-1.0_1"},
+		},
+	})
+	qr := NewQuerier(1, 1, 1)
+	qr.SetData(&archIndex{archs: map[string]*RepoData{"x86_64": rd}})
+
+	type candidate struct {
+		Repository string `json:"repository"`
+		Version    string `json:"version"`
+		Revision   int    `json:"revision"`
+		Preferred  bool   `json:"preferred"`
+	}
+
+	cases := []struct {
+		pkg        string
+		repository string
+		version    string
+		candidates []candidate
+	}{
+		{"libfoo", "nonfree", "2", []candidate{
+			{"current", "1", 1, false},
+			{"nonfree", "2", 1, true},
+		}},
+		// Repository order only breaks ties.
+		{"tie", "current", "1.0", []candidate{
+			{"current", "1.0", 1, true},
+			{"nonfree", "1.0", 1, false},
+		}},
+		{"older", "current", "2.0", []candidate{
+			{"current", "2.0", 1, true},
+			{"nonfree", "1.0", 1, false},
+		}},
+	}
+
+	for _, c := range cases {
+		var response struct {
+			Data struct {
+				Repository string      `json:"repository"`
+				Version    string      `json:"version"`
+				Candidates []candidate `json:"candidates"`
+			} `json:"data"`
+		}
+		target := "/v1/packages/x86_64/" + c.pkg
+		params := httprouter.Params{{Key: "arch", Value: "x86_64"}, {Key: "package", Value: c.pkg}}
+		if w := testQuery(t, qr.Package, target, params, &response); w.Code != 200 {
+			t.Errorf("GET %s: status = %d; want 200", target, w.Code)
+			continue
+		}
+		if got := response.Data; got.Repository != c.repository || got.Version != c.version {
+			t.Errorf("GET %s = %s from %s; want %s from %s", target,
+				got.Version, got.Repository, c.version, c.repository)
+		}
+		if !reflect.DeepEqual(response.Data.Candidates, c.candidates) {
+			t.Errorf("GET %s: candidates = %v; want %v", target, response.Data.Candidates, c.candidates)
+		}
+	}
+
+	// Sonames provided only by a candidate that isn't preferred are still found.
+	var response struct {
+		Data struct {
+			ProvidedBy []shortEntry `json:"provided_by"`
+		} `json:"data"`
+	}
+	params := httprouter.Params{{Key: "arch", Value: "x86_64"}, {Key: "soname", Value: "libfoo.so.1"}}
+	if w := testQuery(t, qr.Shlibs, "/v1/shlibs/x86_64/libfoo.so.1", params, &response); w.Code != 200 {
+		t.Fatalf("GET /v1/shlibs/x86_64/libfoo.so.1: status = %d; want 200", w.Code)
+	}
+	want := []shortEntry{{Name: "libfoo", Version: "1", Revision: 1, Repository: "current"}}
+	if !reflect.DeepEqual(response.Data.ProvidedBy, want) {
+		t.Errorf("GET /v1/shlibs/x86_64/libfoo.so.1: provided_by = %v; want %v", response.Data.ProvidedBy, want)
+	}
+}
+
+func TestReposAndRepoFilters(t *testing.T) {
+	rd := testRepoPackages(t, map[string][]*packageData{
+		"current": {{PackageVersion: "a-1.0_1"}, {PackageVersion: "b-1.0_1"}},
+		"nonfree": {{PackageVersion: "b-2.0_1"}, {PackageVersion: "c-1.0_1"}},
+	})
+	qr := NewQuerier(1, 1, 1)
+	qr.SetData(&archIndex{archs: map[string]*RepoData{"x86_64": rd}})
+	arch := httprouter.Params{{Key: "arch", Value: "x86_64"}}
+
+	var repos struct {
+		Data []struct {
+			Name     string `json:"name"`
+			Packages int    `json:"packages"`
+			LoadedAt string `json:"loaded_at"`
+		} `json:"data"`
+	}
+	if w := testQuery(t, qr.Repos, "/v1/repos/x86_64", arch, &repos); w.Code != 200 {
+		t.Fatalf("GET /v1/repos/x86_64: status = %d; want 200", w.Code)
+	}
+	if len(repos.Data) != 2 {
+		t.Fatalf("GET /v1/repos/x86_64: got %d repos; want 2", len(repos.Data))
+	}
+	for i, want := range []string{"current", "nonfree"} {
+		repo := repos.Data[i]
+		if repo.Name != want || repo.Packages != 2 {
+			t.Errorf("repo %d = %s with %d packages; want %s with 2", i, repo.Name, repo.Packages, want)
+		}
+		if !strings.HasSuffix(repo.LoadedAt, "Z") {
+			t.Errorf("repo %s loaded_at = %q; want a UTC time", repo.Name, repo.LoadedAt)
+		}
+	}
+	if w := testQuery(t, qr.Repos, "/v1/repos/i686", httprouter.Params{{Key: "arch", Value: "i686"}}, nil); w.Code != 404 {
+		t.Errorf("GET /v1/repos/i686: status = %d; want 404", w.Code)
+	}
+
+	lists := []struct {
+		target string
+		code   int
+		want   []string
+	}{
+		{"/v1/packages/x86_64", 200, []string{"a", "b", "c"}},
+		{"/v1/packages/x86_64?repo=current", 200, []string{"a", "b"}},
+		{"/v1/packages/x86_64?repo=nonfree", 200, []string{"b", "c"}},
+		{"/v1/packages/x86_64?repo=missing", 404, nil},
+	}
+	for _, c := range lists {
+		var response struct {
+			Data []string `json:"data"`
+		}
+		w := testQuery(t, qr.PackageList, c.target, arch, &response)
+		if w.Code != c.code {
+			t.Errorf("GET %s: status = %d; want %d", c.target, w.Code, c.code)
+		} else if c.code == 200 && !reflect.DeepEqual(response.Data, c.want) {
+			t.Errorf("GET %s = %v; want %v", c.target, response.Data, c.want)
+		}
+	}
+
+	queries := []struct {
+		target string
+		code   int
+		want   []string // name-version
+	}{
+		{"/v1/query/x86_64", 200, []string{"a-1.0", "b-2.0", "c-1.0"}},
+		{"/v1/query/x86_64?repo=current", 200, []string{"a-1.0", "b-1.0"}},
+		{"/v1/query/x86_64?repo=current&q=b", 200, []string{"b-1.0"}},
+		{"/v1/query/x86_64?repo=nonfree&q=a", 200, []string{}},
+		{"/v1/query/x86_64?repo=missing", 404, nil},
+	}
+	for _, c := range queries {
+		var response struct {
+			Data []shortEntry `json:"data"`
+		}
+		w := testQuery(t, qr.Query, c.target, arch, &response)
+		if w.Code != c.code {
+			t.Errorf("GET %s: status = %d; want %d", c.target, w.Code, c.code)
+			continue
+		}
+		if c.code != 200 {
+			continue
+		}
+		got := []string{}
+		for _, p := range response.Data {
+			got = append(got, p.Name+"-"+p.Version)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("GET %s = %v; want %v", c.target, got, c.want)
+		}
+	}
+}
+
+func TestStagedHandler(t *testing.T) {
+	index := &archIndex{
+		archs: map[string]*RepoData{
+			"x86_64": testRepoData(t, map[string][]string{"current": {"a-1.0_1", "b-1.0_1"}}),
+		},
+		staged: map[string]*RepoData{
+			"x86_64":  testRepoData(t, map[string][]string{"current": {"a-1.0_1", "b-1.1_1"}}),
+			"riscv64": testRepoData(t, map[string][]string{"current": {"x-1.0_1"}}),
+		},
+	}
+	if err := index.init(); err != nil {
+		t.Fatal(err)
+	}
+	qr := NewQuerier(1, 1, 1)
+	qr.SetData(index)
+
+	type stagedEntry struct {
+		Name            string `json:"name"`
+		Version         string `json:"version"`
+		CurrentVersion  string `json:"current_version"`
+		CurrentRevision int    `json:"current_revision"`
+	}
+	cases := []struct {
+		arch string
+		code int
+		want []stagedEntry
+	}{
+		{"x86_64", 200, []stagedEntry{{"b", "1.1", "1.0", 1}}},
+		{"riscv64", 200, []stagedEntry{{"x", "1.0", "", 0}}},
+		{"i686", 404, nil},
+	}
+	for _, c := range cases {
+		var response struct {
+			Data []stagedEntry `json:"data"`
+		}
+		target := "/v1/staged/" + c.arch
+		w := testQuery(t, qr.Staged, target, httprouter.Params{{Key: "arch", Value: c.arch}}, &response)
+		if w.Code != c.code {
+			t.Errorf("GET %s: status = %d; want %d", target, w.Code, c.code)
+		} else if c.code == 200 && !reflect.DeepEqual(response.Data, c.want) {
+			t.Errorf("GET %s = %v; want %v", target, response.Data, c.want)
+		}
+	}
+
+	// Arches with only stage data are listed by /v1/archs and /v1/status as well.
+	want := []string{"riscv64", "x86_64"}
+	var archs struct {
+		Data []string `json:"data"`
+	}
+	testQuery(t, qr.Archs, "/v1/archs", nil, &archs)
+	if !reflect.DeepEqual(archs.Data, want) {
+		t.Errorf("GET /v1/archs = %q; want %q", archs.Data, want)
+	}
+
+	var status struct {
+		Data struct {
+			Archs []struct {
+				Arch string `json:"arch"`
+			} `json:"archs"`
+		} `json:"data"`
+	}
+	testQuery(t, qr.Status, "/v1/status", nil, &status)
+	var got []string
+	for _, a := range status.Data.Archs {
+		got = append(got, a.Arch)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GET /v1/status archs = %q; want %q", got, want)
+	}
+}
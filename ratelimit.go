@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// rateLimiter limits the rate of requests from each client with a token bucket per client.
+// Clients are identified by their remote address or, for requests from trusted proxies, by the
+// X-Forwarded-For header. IPv6 clients share a bucket per /64, since a single host can usually
+// use any address in its /64.
+type rateLimiter struct {
+	rate       float64 // Tokens added per second
+	burst      float64 // Bucket size
+	proxies    []*net.IPNet
+	maxClients int // Maximum number of buckets kept
+
+	mu        sync.Mutex
+	clients   map[string]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+const (
+	// sweepInterval is how often full buckets are removed from a rateLimiter.
+	sweepInterval = time.Minute
+
+	// maxRateLimitClients is the number of buckets a rateLimiter keeps. If a new client arrives
+	// when there are this many, an arbitrary bucket is removed to make room for it.
+	maxRateLimitClients = 100000
+
+	// ipv6PrefixBits is the size of the prefix that IPv6 clients are identified by.
+	ipv6PrefixBits = 64
+)
+
+// newRateLimiter returns a rateLimiter that allows rate requests per second from each client, with
+// bursts of up to burst requests. If burst < 1, it allows bursts of one request. X-Forwarded-For
+// is only used for requests from trustedProxies, which are IP addresses or CIDR blocks.
+func newRateLimiter(rate float64, burst int, trustedProxies []string) (*rateLimiter, error) {
+	if rate <= 0 {
+		return nil, fmt.Errorf("rate limit must be greater than 0")
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	proxies, err := parseTrustedProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &rateLimiter{
+		rate:       rate,
+		burst:      float64(burst),
+		proxies:    proxies,
+		maxClients: maxRateLimitClients,
+		clients:    map[string]*tokenBucket{},
+		now:        time.Now,
+	}, nil
+}
+
+func parseTrustedProxies(addrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(addrs))
+	for _, addr := range addrs {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", addr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", addr, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// Allow takes a token from the client's bucket. If the bucket is empty, it returns false and how
+// long until the bucket has a token again.
+func (rl *rateLimiter) Allow(client string) (ok bool, retryAfter time.Duration) {
+	client = bucketKey(client)
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := rl.now()
+	rl.sweep(now)
+
+	b := rl.clients[client]
+	if b == nil {
+		// Make room for the new bucket. Map iteration order is random, so this removes an
+		// arbitrary bucket.
+		for key := range rl.clients {
+			if len(rl.clients) < rl.maxClients {
+				break
+			}
+			delete(rl.clients, key)
+		}
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.clients[client] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := (1 - b.tokens) / rl.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep removes the buckets of clients that have been idle long enough to refill them. It runs
+// at most once per sweepInterval.
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < sweepInterval {
+		return
+	}
+	rl.lastSweep = now
+	for client, b := range rl.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.clients, client)
+		}
+	}
+}
+
+// bucketKey returns the key of a client's bucket. IPv6 addresses are masked to their /64 prefix,
+// so that a client can't get more requests by using more addresses. Other clients are their own
+// key.
+func bucketKey(client string) string {
+	ip := net.ParseIP(client)
+	if ip == nil || ip.To4() != nil {
+		return client
+	}
+	mask := net.CIDRMask(ipv6PrefixBits, 8*net.IPv6len)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// Client returns the address that identifies the client making req. This is the remote address
+// unless it's a trusted proxy, in which case it's the last address in X-Forwarded-For that isn't
+// a trusted proxy.
+func (rl *rateLimiter) Client(req *http.Request) string {
+	addr := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !rl.trusted(addr) {
+		return addr
+	}
+
+	var forwarded []string
+	for _, xff := range req.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(xff, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			// Anything before an invalid address can't be trusted.
+			break
+		}
+		addr = ip.String()
+		if !rl.trusted(addr) {
+			break
+		}
+	}
+	return addr
+}
+
+func (rl *rateLimiter) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, ipnet := range rl.proxies {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetRateLimiter sets the rateLimiter used to limit requests per client. If rl is nil, requests
+// are not rate limited.
+func (qr *Querier) SetRateLimiter(rl *rateLimiter) {
+	qr.limiter = rl
+}
+
+// RateLimited returns a handler that responds with 429 Too Many Requests to clients that exceed
+// the rate limit and calls h otherwise.
+func (qr *Querier) RateLimited(h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if qr.limiter != nil {
+			if ok, retryAfter := qr.limiter.Allow(qr.limiter.Client(req)); !ok {
+				qr.retryLater(w, http.StatusTooManyRequests, retryAfter, "rate limit exceeded")
+				return
+			}
+		}
+		h(w, req, params)
+	}
+}
+
+// retryLater responds with an error and a Retry-After header telling the client how long to wait
+// before retrying, rounded up to the second.
+func (qr *Querier) retryLater(w http.ResponseWriter, code int, retryAfter time.Duration, msg string) {
+	secs := int64(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", fmt.Sprint(secs))
+	w.Header().Set("Cache-Control", "no-store")
+	response := struct {
+		Error string `json:"error"`
+	}{
+		Error: msg,
+	}
+	qr.reply(w, code, response)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl, err := newRateLimiter(2, 3, []string{"10.0.0.1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1600000000, 0)
+	rl.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.Allow("a"); !ok {
+			t.Fatalf("request %d denied; want allowed", i+1)
+		}
+	}
+	if ok, retry := rl.Allow("a"); ok || retry != 500*time.Millisecond {
+		t.Fatalf("Allow() = %t, %v; want false, 500ms", ok, retry)
+	}
+	if ok, _ := rl.Allow("b"); !ok {
+		t.Fatal("other client denied; want allowed")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := rl.Allow("a"); !ok {
+		t.Fatal("request after refill denied; want allowed")
+	}
+
+	// Full buckets are removed once the sweep interval passes.
+	now = now.Add(sweepInterval)
+	rl.Allow("c")
+	if _, ok := rl.clients["a"]; ok {
+		t.Error("idle client was not swept")
+	}
+
+	// IPv6 clients share a bucket per /64.
+	for i := 0; i < 3; i++ {
+		rl.Allow("2001:db8::1")
+	}
+	if ok, _ := rl.Allow("2001:db8::2"); ok {
+		t.Error("address in an exhausted /64 allowed; want denied")
+	}
+	if ok, _ := rl.Allow("2001:db8:0:1::1"); !ok {
+		t.Error("address in another /64 denied; want allowed")
+	}
+
+	// The number of buckets is capped.
+	rl.maxClients = 4
+	for i := 0; i < 10; i++ {
+		rl.Allow(fmt.Sprint("client", i))
+	}
+	if n := len(rl.clients); n != rl.maxClients {
+		t.Errorf("limiter has %d buckets; want %d", n, rl.maxClients)
+	}
+
+	cases := []struct {
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"203.0.113.5:1234", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1, 198.51.100.2, 192.168.1.1"}, "198.51.100.2"},
+		{"10.0.0.1:1234", []string{"198.51.100.1", "192.168.1.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1, bogus"}, "10.0.0.1"},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/v1/archs", nil)
+		req.RemoteAddr = c.remote
+		for _, xff := range c.xff {
+			req.Header.Add("X-Forwarded-For", xff)
+		}
+		if got := rl.Client(req); got != c.want {
+			t.Errorf("Client(%s, %q) = %q; want %q", c.remote, c.xff, got, c.want)
+		}
+	}
+}
+
+func TestQueryWait(t *testing.T) {
+	qr := NewQuerier(1, 1, 1)
+	qr.SetQueryWait(10 * time.Millisecond)
+
+	release, ok := qr.acquire(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !ok {
+		t.Fatal("first acquire failed")
+	}
+
+	w := httptest.NewRecorder()
+	if _, ok := qr.acquire(w, httptest.NewRequest("GET", "/", nil)); ok {
+		t.Fatal("acquire succeeded with no free slots")
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("status = %d, Retry-After = %q; want 503, 1", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	// Canceled requests stop waiting without a response.
+	qr.SetQueryWait(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	if _, ok := qr.acquire(w, req); ok {
+		t.Fatal("acquire succeeded for a canceled request")
+	}
+	if w.Body.Len() != 0 {
+		t.Errorf("canceled request got a response: %s", w.Body)
+	}
+
+	// Canceled requests are recorded with a 499.
+	h := qr.metrics.Instrument(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		qr.acquire(w, req)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	var sb strings.Builder
+	qr.metrics.requests.WriteTo(&sb)
+	if want := `xqapi_http_requests_total{route="other",method="GET",code="499"} 1`; !strings.Contains(sb.String(), want) {
+		t.Errorf("metrics missing %s:\n%s", want, sb.String())
+	}
+
+	release()
+	if release, ok := qr.acquire(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil)); !ok {
+		t.Error("acquire failed after release")
+	} else {
+		release()
+	}
+}
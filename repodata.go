@@ -18,6 +18,7 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/golang/glog"
 	"github.com/klauspost/compress/zstd"
@@ -28,6 +29,7 @@ import (
 var etagEncoding = base64.RawURLEncoding
 
 const repoIndexFile = "index.plist"
+const repoMetaFile = "index-meta.plist"
 const defaultRepository = "current"
 
 var errNoIndex = fmt.Errorf("index not found: %s", repoIndexFile)
@@ -100,26 +102,123 @@ func (ps packageIndex) splitFilter(fn FilterFunc) packageIndex {
 }
 
 type RepoData struct {
-	root      packageMap
-	index     packageIndex
-	nameIndex []string
-	etag      string
+	// TrustedKeys, if set, is a directory of trusted public keys in the same form as xbps's
+	// keys directory (i.e., <fingerprint>.plist files). Repository indices that are not signed
+	// by a trusted key are rejected.
+	TrustedKeys string
+
+	root       packageMap              // Preferred package by name
+	candidates map[string]packageIndex // All packages by name, in load order
+	index      packageIndex
+	nameIndex  []string
+	etag       string
+
+	sources []repoSource
+
+	// Derived indices (see buildIndices)
+	repoIndex      map[string]packageIndex
+	revdeps        map[string][]revdep
+	shlibProviders map[string]packageIndex
+	shlibRequirers map[string]packageIndex
+}
+
+// revdep is a package that depends on another package through one of its run_depends patterns.
+type revdep struct {
+	Package *packageData
+	Pattern string
+}
+
+// repoSource describes a repository index loaded into a RepoData.
+type repoSource struct {
+	Repository string    `json:"name"`
+	Path       string    `json:"path,omitempty"` // Empty if not loaded from a file
+	ModTime    time.Time `json:"mod_time"`       // Zero if not loaded from a file
+	Size       int64     `json:"size,omitempty"`
+	LoadedAt   time.Time `json:"loaded_at"`
+	Packages   int       `json:"packages"`
+
+	Meta *repoMetaInfo `json:"meta,omitempty"` // Nil if the repodata had no index-meta.plist
+
+	// Kept for snapshots (see writeSnapshot)
+	hash     []byte // SHA-256 of the file, if loaded from a file
+	meta     *repoMeta
+	packages []*packageData
 }
 
 func NewRepoData() *RepoData {
 	return &RepoData{
-		root: packageMap{},
+		root:       packageMap{},
+		candidates: map[string]packageIndex{},
 	}
 }
 
 func (rd *RepoData) LoadRepo(path, repo string) error {
-	fi, err := os.Open(path)
+	dr, err := decodeRepoFile(path, repo, rd.TrustedKeys, nil, false)
 	if err != nil {
 		return err
 	}
+	return rd.merge(dr)
+}
+
+// decodedRepo is a repository index that has been decoded and prepared but not yet merged into
+// a RepoData. Decoding doesn't depend on other repositories, so indices can be decoded
+// concurrently and then merged in order.
+type decodedRepo struct {
+	repo  string
+	index packageMap
+	meta  *repoMeta
+
+	// Set if decoded from a file
+	path    string
+	modTime time.Time
+	size    int64
+	hash    []byte // SHA-256, if needed for a snapshot
+}
+
+// decodeRepoFile decodes the repository index at path. If keysDir is set, the index must be
+// signed by a trusted key in keysDir. Packages are interned in pool, which may be nil. If
+// hash is true, the file's SHA-256 hash is also computed for snapshots.
+func decodeRepoFile(path, repo, keysDir string, pool *packagePool, hash bool) (*decodedRepo, error) {
+	fi, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
 	defer fi.Close()
 
-	return rd.ReadRepo(fi, repo)
+	size, modTime, err := statRepo(fi)
+	if err != nil {
+		return nil, err
+	}
+	var sum []byte
+	if hash {
+		if sum, err = hashRepo(fi); err != nil {
+			return nil, err
+		}
+	}
+
+	dr, err := decodeRepo(fi, repo, keysDir, pool)
+	if err != nil {
+		return nil, err
+	}
+	dr.path, dr.modTime, dr.size, dr.hash = path, modTime, size, sum
+	return dr, nil
+}
+
+// Sources returns the repository indices loaded into rd, in load order.
+func (rd *RepoData) Sources() []repoSource {
+	if rd == nil {
+		return nil
+	}
+	return rd.sources
+}
+
+// RepoIndex returns all packages, ordered by name, from the named repository. Unlike Index,
+// this includes packages that are not preferred.
+func (rd *RepoData) RepoIndex(repo string) packageIndex {
+	if rd == nil {
+		return nil
+	}
+	return rd.repoIndex[repo]
 }
 
 func (rd *RepoData) Index() packageIndex {
@@ -136,7 +235,7 @@ func (rd *RepoData) NameIndex() []string {
 	return rd.nameIndex
 }
 
-func (rd *RepoData) zstdReader(r io.Reader) (io.ReadCloser, error) {
+func zstdReader(r io.Reader) (io.ReadCloser, error) {
 	dec, err := zstd.NewReader(r)
 	if err != nil {
 		return nil, err
@@ -144,11 +243,23 @@ func (rd *RepoData) zstdReader(r io.Reader) (io.ReadCloser, error) {
 	return newErrorCloser(dec), nil
 }
 
-func (rd *RepoData) gzipReader(r io.Reader) (io.ReadCloser, error) {
+func gzipReader(r io.Reader) (io.ReadCloser, error) {
 	return gzip.NewReader(r)
 }
 
 func (rd *RepoData) ReadRepo(r io.ReadSeeker, repo string) error {
+	dr, err := decodeRepo(r, repo, rd.TrustedKeys, nil)
+	if err != nil {
+		return err
+	}
+	return rd.merge(dr)
+}
+
+// decodeRepo decodes a zstd or gzip compressed repository index from r. If keysDir is set, the
+// index must be signed by a trusted key in keysDir. Packages are interned in pool, which may be
+// nil.
+func decodeRepo(r io.ReadSeeker, repo, keysDir string, pool *packagePool) (*decodedRepo, error) {
+	var dr *decodedRepo
 	read := func(rs io.ReadSeeker, decompress func(rs io.Reader) (io.ReadCloser, error)) error {
 		_, err := rs.Seek(0, io.SeekStart)
 		if err != nil {
@@ -162,18 +273,35 @@ func (rd *RepoData) ReadRepo(r io.ReadSeeker, repo string) error {
 		}
 		defer rc.Close()
 
+		var (
+			index packageMap
+			meta  *repoMeta
+		)
 		tr := tar.NewReader(rc)
 		for {
 			hdr, err := tr.Next()
-			if err != nil {
+			if err == io.EOF {
+				break
+			} else if err != nil {
 				return err
 			}
 
-			if hdr.Name == repoIndexFile {
-				return rd.ReadRepoIndex(tr, repo)
+			switch hdr.Name {
+			case repoIndexFile:
+				index, err = decodeRepoIndex(tr)
+			case repoMetaFile:
+				meta, err = decodeRepoMeta(tr)
+			}
+			if err != nil {
+				return err
 			}
 		}
-		return errNoIndex
+
+		if index == nil {
+			return errNoIndex
+		}
+		dr, err = prepareRepo(index, meta, repo, keysDir, pool)
+		return err
 	}
 
 	type decompressor struct {
@@ -182,24 +310,24 @@ func (rd *RepoData) ReadRepo(r io.ReadSeeker, repo string) error {
 	}
 
 	decompressors := []decompressor{
-		{"zstd", rd.zstdReader},
-		{"gzip", rd.gzipReader},
+		{"zstd", zstdReader},
+		{"gzip", gzipReader},
 	}
 	var err error
 	for _, dec := range decompressors {
 		switch err = read(r, dec.fn); {
 		case err == nil:
-			return nil // OK
+			return dr, nil // OK
 		case errors.Is(err, zstd.ErrMagicMismatch),
 			errors.Is(err, tar.ErrHeader),
 			errors.Is(err, io.ErrUnexpectedEOF),
 			errors.Is(err, gzip.ErrHeader):
 			// Retry as next
 		case err != nil:
-			return fmt.Errorf("error parsing %s repodata: %w", dec.name, err)
+			return nil, fmt.Errorf("error parsing %s repodata: %w", dec.name, err)
 		}
 	}
-	return err
+	return nil, err
 }
 
 func copyToTempFile(r io.Reader) (*os.File, error) {
@@ -220,33 +348,65 @@ func copyToTempFile(r io.Reader) (*os.File, error) {
 	return tmpfile, nil
 }
 
-func (rd *RepoData) ReadRepoIndex(r io.Reader, repo string) error {
-	var err error
-	rs, ok := r.(io.ReadSeeker)
-	if !ok {
-		var f *os.File
-		if f, err = copyToTempFile(r); err != nil {
-			return err
-		}
-		defer f.Close()
-		rs = f
+// readSeeker returns r as an io.ReadSeeker, copying it to a temporary file if necessary. The
+// returned close function must be called once the io.ReadSeeker is no longer needed.
+func readSeeker(r io.Reader) (rs io.ReadSeeker, close func() error, err error) {
+	if rs, ok := r.(io.ReadSeeker); ok {
+		return rs, func() error { return nil }, nil
+	}
+	f, err := copyToTempFile(r)
+	if err != nil {
+		return nil, nil, err
 	}
+	return f, f.Close, nil
+}
 
-	if repo == "" {
-		repo = defaultRepository
+func decodeRepoIndex(r io.Reader) (packageMap, error) {
+	rs, close, err := readSeeker(r)
+	if err != nil {
+		return nil, err
 	}
+	defer close()
 
 	pkg := packageMap{}
-	err = plist.NewDecoder(rs).Decode(pkg)
+	if err = plist.NewDecoder(rs).Decode(pkg); err != nil {
+		return nil, err
+	}
+	return pkg, nil
+}
+
+// ReadRepoIndex reads an index.plist from r and merges it into rd. Because it has no
+// repository metadata, it cannot be read if rd requires trusted keys.
+func (rd *RepoData) ReadRepoIndex(r io.Reader, repo string) error {
+	pkg, err := decodeRepoIndex(r)
 	if err != nil {
 		return err
 	}
+	return rd.mergeRepoIndex(pkg, nil, repo)
+}
+
+func (rd *RepoData) mergeRepoIndex(pkg packageMap, meta *repoMeta, repo string) error {
+	dr, err := prepareRepo(pkg, meta, repo, rd.TrustedKeys, nil)
+	if err != nil {
+		return err
+	}
+	return rd.merge(dr)
+}
+
+// prepareRepo verifies a decoded repository index, if keysDir is set, and prepares its packages
+// to be merged into a RepoData. Packages are interned in pool, which may be nil.
+func prepareRepo(pkg packageMap, meta *repoMeta, repo, keysDir string, pool *packagePool) (_ *decodedRepo, err error) {
+	if repo == "" {
+		repo = defaultRepository
+	}
+
+	if keysDir != "" {
+		if err := meta.verify(keysDir); err != nil {
+			return nil, err
+		}
+	}
 
-	// Merge indices and maps -- this gets around a flaw in howett.net/plist where decoding into
-	// an existing dataset will result in an invalid use of the reflect package and panic.
-	index := rd.index
 	for k, p := range pkg {
-		old, ok := rd.root[k]
 		if p.Name == "" {
 			p.Name = k
 			_, p.Version, p.Revision, _ = ParseVersionedName(p.PackageVersion)
@@ -254,24 +414,41 @@ func (rd *RepoData) ReadRepoIndex(r io.Reader, repo string) error {
 
 		p.Repository = repo
 
-		// Do naive case normalization for searches -- shouldn't have an impact on these
-		// given that everything in repodata is currently ASCII.
-		p.SearchPackageVersion = strings.ToLower(p.PackageVersion)
-		p.SearchShortDesc = strings.ToLower(p.ShortDesc)
-
 		p.ETag, err = p.computeETag()
 		if err != nil {
 			// This really shouldn't happen -- it would mean JSON encoding of packages
 			// was broken.
 			glog.Errorf("unable to compute etag for %q: %v", p.PackageVersion, err)
-			return err
+			return nil, err
 		}
+		pkg[k] = pool.intern(p)
+	}
+	return &decodedRepo{repo: repo, index: pkg, meta: meta}, nil
+}
 
-		rd.root[k] = p
-		if ok {
-			index[old.Index] = p
-		} else {
+// merge merges a decoded repository index into rd. Repositories must be merged in the same order
+// to produce the same RepoData.
+func (rd *RepoData) merge(dr *decodedRepo) error {
+	// Merge indices and maps -- this gets around a flaw in howett.net/plist where decoding into
+	// an existing dataset will result in an invalid use of the reflect package and panic.
+	//
+	// Every package is kept as a candidate for its name, but only the preferred candidate is
+	// kept in the root map and index. Packages may be shared with other RepoData (see
+	// packagePool), so they aren't modified.
+	index := rd.index
+	sorted := len(index) // Packages already in the index are sorted by name
+	packages := make([]*packageData, 0, len(dr.index))
+	for k, p := range dr.index {
+		packages = append(packages, p)
+		old, ok := rd.root[k]
+		rd.candidates[k] = append(rd.candidates[k], p)
+		if !ok {
+			rd.root[k] = p
 			index = append(index, p)
+		} else if p.preferredOver(old) {
+			rd.root[k] = p
+			i := sort.Search(sorted, func(i int) bool { return index[i].Name >= k })
+			index[i] = p
 		}
 	}
 
@@ -279,11 +456,19 @@ func (rd *RepoData) ReadRepoIndex(r io.Reader, repo string) error {
 		return index[i].Name < index[j].Name
 	})
 
-	for i, p := range index {
-		p.Index = i
-	}
-
 	rd.index = index
+	rd.sources = append(rd.sources, repoSource{
+		Repository: dr.repo,
+		Path:       dr.path,
+		ModTime:    dr.modTime,
+		Size:       dr.size,
+		LoadedAt:   time.Now().UTC(),
+		Packages:   len(dr.index),
+		Meta:       dr.meta.info(),
+		hash:       dr.hash,
+		meta:       dr.meta,
+		packages:   packages,
+	})
 
 	names := rd.nameIndex[:0]
 	for _, p := range rd.index {
@@ -307,6 +492,239 @@ func (rd *RepoData) Package(name string) *packageData {
 	return rd.root[name]
 }
 
+// Candidates returns every package loaded for the given name, in the order they were loaded.
+// This includes the preferred package returned by Package.
+func (rd *RepoData) Candidates(name string) packageIndex {
+	if rd == nil {
+		return nil
+	}
+	return rd.candidates[name]
+}
+
+// CandidatesETag returns an ETag for all candidates of the given name.
+func (rd *RepoData) CandidatesETag(name string) string {
+	cands := rd.Candidates(name)
+	if len(cands) == 1 {
+		return cands[0].ETag
+	}
+	etags := make([]string, len(cands))
+	for i, p := range cands {
+		etags[i] = p.ETag
+	}
+	return joinETags(etags...)
+}
+
+// joinETags returns a single ETag for a combination of ETags.
+func joinETags(etags ...string) string {
+	h := sha1.New()
+	for _, etag := range etags {
+		binary.Write(h, binary.LittleEndian, int64(len(etag)))
+		io.WriteString(h, etag)
+	}
+	sum := h.Sum(make([]byte, 0, h.Size()))
+	return `W/"` + etagEncoding.EncodeToString(sum) + `"`
+}
+
+// Resolve returns the package in rd that satisfies the given pattern. The preferred package for
+// a name is checked before other candidates. If no package satisfies pat, it returns nil.
+func (rd *RepoData) Resolve(pat *Pattern) *packageData {
+	if rd == nil {
+		return nil
+	}
+
+	if pat.Name != "" {
+		if p := rd.Package(pat.Name); pat.MatchPackage(p) {
+			return p
+		}
+		for _, p := range rd.candidates[pat.Name] {
+			if pat.MatchPackage(p) {
+				return p
+			}
+		}
+		return nil
+	}
+
+	// Patterns without a name (i.e., some globs) have to be checked against every package.
+	for _, p := range rd.index {
+		if pat.MatchPackage(p) {
+			return p
+		}
+	}
+	return nil
+}
+
+// RevDeps returns the packages, including candidates that are not preferred, whose run_depends
+// are satisfied by the named package.
+func (rd *RepoData) RevDeps(name string) []revdep {
+	if rd == nil {
+		return nil
+	}
+	return rd.revdeps[name]
+}
+
+// ShlibProviders returns the packages, including candidates that are not preferred, that
+// provide the given soname.
+func (rd *RepoData) ShlibProviders(soname string) packageIndex {
+	if rd == nil {
+		return nil
+	}
+	return rd.shlibProviders[soname]
+}
+
+// ShlibRequirers returns the packages, including candidates that are not preferred, that
+// require the given soname.
+func (rd *RepoData) ShlibRequirers(soname string) packageIndex {
+	if rd == nil {
+		return nil
+	}
+	return rd.shlibRequirers[soname]
+}
+
+// buildIndices builds indices derived from all packages loaded into rd. It must be called after
+// all repositories for rd have been loaded.
+func (rd *RepoData) buildIndices() {
+	repoIndex := map[string]packageIndex{}
+	revdeps := map[string][]revdep{}
+	providers := map[string]packageIndex{}
+	requirers := map[string]packageIndex{}
+	// Every candidate is indexed, not just preferred packages, since a candidate from another
+	// repository may provide or depend on something its preferred package doesn't.
+	for _, pref := range rd.index {
+		for _, p := range rd.candidates[pref.Name] {
+			repoIndex[p.Repository] = append(repoIndex[p.Repository], p)
+
+			for _, soname := range p.ShlibProvides {
+				providers[soname] = append(providers[soname], p)
+			}
+			for _, soname := range p.ShlibRequires {
+				requirers[soname] = append(requirers[soname], p)
+			}
+
+			for _, dep := range p.RunDepends {
+				pat, err := ParsePattern(dep)
+				if err != nil {
+					glog.V(2).Infof("ignoring run_depends %q of %s: %v", dep, p.PackageVersion, err)
+					continue
+				}
+				match := rd.Resolve(pat)
+				if match == nil {
+					continue
+				}
+				revdeps[match.Name] = append(revdeps[match.Name], revdep{
+					Package: p,
+					Pattern: dep,
+				})
+			}
+		}
+	}
+	rd.repoIndex = repoIndex
+	rd.revdeps = revdeps
+	rd.shlibProviders = providers
+	rd.shlibRequirers = requirers
+}
+
+// resolvedDepend describes the package, if any, that satisfies a dependency pattern.
+type resolvedDepend struct {
+	Pattern   string      `json:"pattern"`
+	Kind      patternKind `json:"kind,omitempty"`
+	Name      string      `json:"name,omitempty"`
+	Satisfied bool        `json:"satisfied"`
+	Version   string      `json:"version,omitempty"`
+	Revision  int         `json:"revision,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// ResolveDepends resolves each of the package's run_depends patterns against rd.
+func (rd *RepoData) ResolveDepends(p *packageData) []resolvedDepend {
+	deps := make([]resolvedDepend, len(p.RunDepends))
+	for i, dep := range p.RunDepends {
+		deps[i].Pattern = dep
+		pat, err := ParsePattern(dep)
+		if err != nil {
+			deps[i].Error = err.Error()
+			continue
+		}
+		deps[i].Kind = pat.Kind
+		deps[i].Name = pat.Name
+
+		if match := rd.Resolve(pat); match != nil {
+			deps[i].Name = match.Name
+			deps[i].Satisfied = true
+			deps[i].Version = match.Version
+			deps[i].Revision = match.Revision
+		}
+	}
+	return deps
+}
+
+// closureEntry is a package in a dependency closure and the depth at which it was first
+// reached. Packages requested directly have a depth of 0.
+type closureEntry struct {
+	Package *packageData
+	Depth   int
+}
+
+// unsatisfiedDepend is a dependency pattern that could not be resolved while computing
+// a dependency closure.
+type unsatisfiedDepend struct {
+	Pattern    string `json:"pattern"`
+	RequiredBy string `json:"required_by,omitempty"`
+}
+
+// Closure returns the transitive run_depends closure of the named packages, ordered by depth
+// and then name. Names that do not exist and dependencies that cannot be resolved are returned
+// as unsatisfied.
+func (rd *RepoData) Closure(names []string) (entries []closureEntry, unsatisfied []unsatisfiedDepend) {
+	seen := map[string]bool{}
+	var queue []closureEntry
+	for _, name := range names {
+		p := rd.Package(name)
+		if p == nil {
+			unsatisfied = append(unsatisfied, unsatisfiedDepend{Pattern: name})
+			continue
+		}
+		if !seen[p.Name] {
+			seen[p.Name] = true
+			queue = append(queue, closureEntry{Package: p})
+		}
+	}
+
+	// Breadth-first so that each package is recorded at the shallowest depth it's needed.
+	for len(queue) > 0 {
+		e := queue[0]
+		queue = queue[1:]
+		entries = append(entries, e)
+
+		for _, dep := range e.Package.RunDepends {
+			var match *packageData
+			if pat, err := ParsePattern(dep); err == nil {
+				match = rd.Resolve(pat)
+			}
+			if match == nil {
+				unsatisfied = append(unsatisfied, unsatisfiedDepend{
+					Pattern:    dep,
+					RequiredBy: e.Package.Name,
+				})
+				continue
+			}
+			if seen[match.Name] {
+				continue
+			}
+			seen[match.Name] = true
+			queue = append(queue, closureEntry{Package: match, Depth: e.Depth + 1})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Depth != entries[j].Depth {
+			return entries[i].Depth < entries[j].Depth
+		}
+		return entries[i].Package.Name < entries[j].Package.Name
+	})
+
+	return entries, unsatisfied
+}
+
 func (rd *RepoData) computeETag() (string, error) {
 	h := sha1.New()
 
@@ -315,10 +733,12 @@ func (rd *RepoData) computeETag() (string, error) {
 		return "", err
 	}
 
-	for _, p := range index {
-		binary.Write(h, binary.LittleEndian, int64(len(p.PackageVersion)+len(p.ETag)))
-		io.WriteString(h, p.PackageVersion)
-		io.WriteString(h, p.ETag)
+	for _, pref := range index {
+		for _, p := range rd.candidates[pref.Name] {
+			binary.Write(h, binary.LittleEndian, int64(len(p.PackageVersion)+len(p.ETag)))
+			io.WriteString(h, p.PackageVersion)
+			io.WriteString(h, p.ETag)
+		}
 	}
 
 	sum := h.Sum(make([]byte, 0, h.Size()))
@@ -327,6 +747,9 @@ func (rd *RepoData) computeETag() (string, error) {
 }
 
 func (rd *RepoData) ETag() string {
+	if rd == nil {
+		return ""
+	}
 	return rd.etag
 }
 
@@ -430,12 +853,53 @@ type packageData struct {
 
 	ConfFiles []string `plist:"conf_files" json:"conf_files,omitempty"`
 
-	// Lower-case versions of PackageVersion and ShortDesc for searching
-	SearchPackageVersion string `plist:"-" json:"-"`
-	SearchShortDesc      string `plist:"-" json:"-"`
+	ETag string `plist:"-" json:"-"`
+}
+
+// matchesQuery returns whether p's pkgver or short description contains query, ignoring case.
+// query must be lower-case.
+func (p *packageData) matchesQuery(query string) bool {
+	return containsLower(p.PackageVersion, query) || containsLower(p.ShortDesc, query)
+}
+
+// containsLower returns whether the lower-case form of s contains substr, which must be
+// lower-case. Unless s contains non-ASCII characters, this doesn't allocate a lower-case copy
+// of s.
+func containsLower(s, substr string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return strings.Contains(strings.ToLower(s), substr)
+		}
+	}
+
+	n := len(substr)
+search:
+	for i := 0; i+n <= len(s); i++ {
+		for j := 0; j < n; j++ {
+			c := s[i+j]
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			if c != substr[j] {
+				continue search
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// VersionRevision returns the package's version and revision in the form version_revision.
+func (p *packageData) VersionRevision() string {
+	return p.Version + "_" + strconv.Itoa(p.Revision)
+}
 
-	Index int    `plist:"-" json:"-"`
-	ETag  string `plist:"-" json:"-"`
+// preferredOver returns whether p should be preferred over another candidate with the same
+// name. Unlike xbps, which uses the first repository with a package, the newest version is
+// preferred regardless of repository order. Repository order only breaks ties: if both have the
+// same version, the candidate loaded first is kept.
+func (p *packageData) preferredOver(old *packageData) bool {
+	return CompareVersions(p.VersionRevision(), old.VersionRevision()) > 0
 }
 
 func (p *packageData) computeETag() (string, error) {
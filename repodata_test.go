@@ -0,0 +1,144 @@
+package main
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestRepoDataRevDeps(t *testing.T) {
+	rd := testRepoPackages(t, map[string][]*packageData{
+		"current": {
+			{PackageVersion: "foo-1.2_1"},
+			{PackageVersion: "bar-1.0_1", RunDepends: []string{"foo>=1"}},
+			{PackageVersion: "baz-1.0_1", RunDepends: []string{"foo-1.2_1", "bar>=0"}},
+			{PackageVersion: "old-1.0_1", RunDepends: []string{"foo<1"}},
+			{PackageVersion: "glob-1.0_1", RunDepends: []string{"foo-1.[0-9]*"}},
+			{PackageVersion: "bad-1.0_1", RunDepends: []string{">=1"}},
+		},
+	})
+
+	type dep struct {
+		name    string
+		pattern string
+	}
+	cases := []struct {
+		name string
+		want []dep
+	}{
+		{"foo", []dep{{"bar", "foo>=1"}, {"baz", "foo-1.2_1"}, {"glob", "foo-1.[0-9]*"}}},
+		{"bar", []dep{{"baz", "bar>=0"}}},
+		{"baz", nil},
+		{"missing", nil},
+	}
+
+	for _, c := range cases {
+		var got []dep
+		for _, d := range rd.RevDeps(c.name) {
+			got = append(got, dep{d.Package.Name, d.Pattern})
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("RevDeps(%q) = %v; want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRepoDataClosure(t *testing.T) {
+	rd := testRepoPackages(t, map[string][]*packageData{
+		"current": {
+			{PackageVersion: "app-1.0_1", RunDepends: []string{"liba>=1", "libb-1.0_1"}},
+			{PackageVersion: "liba-1.0_1", RunDepends: []string{"libc>=0"}},
+			{PackageVersion: "libb-1.0_1", RunDepends: []string{"libc>=0", "missing>=1"}},
+			{PackageVersion: "libc-1.0_1", RunDepends: []string{"liba>=1"}}, // Cycle through liba
+			{PackageVersion: "solo-1.0_1"},
+		},
+	})
+
+	cases := []struct {
+		names       []string
+		entries     []string // name:depth
+		unsatisfied []unsatisfiedDepend
+	}{
+		{
+			names:       []string{"app"},
+			entries:     []string{"app:0", "liba:1", "libb:1", "libc:2"},
+			unsatisfied: []unsatisfiedDepend{{Pattern: "missing>=1", RequiredBy: "libb"}},
+		},
+		{
+			names:   []string{"libc"},
+			entries: []string{"libc:0", "liba:1"},
+		},
+		{
+			// Packages are recorded at the shallowest depth they're needed.
+			names:       []string{"liba", "app"},
+			entries:     []string{"app:0", "liba:0", "libb:1", "libc:1"},
+			unsatisfied: []unsatisfiedDepend{{Pattern: "missing>=1", RequiredBy: "libb"}},
+		},
+		{
+			names:       []string{"solo", "nope", "solo"},
+			entries:     []string{"solo:0"},
+			unsatisfied: []unsatisfiedDepend{{Pattern: "nope"}},
+		},
+	}
+
+	for _, c := range cases {
+		entries, unsatisfied := rd.Closure(c.names)
+		var got []string
+		for _, e := range entries {
+			got = append(got, e.Package.Name+":"+strconv.Itoa(e.Depth))
+		}
+		if !reflect.DeepEqual(got, c.entries) {
+			t.Errorf("Closure(%q) entries = %v; want %v", c.names, got, c.entries)
+		}
+		if !reflect.DeepEqual(unsatisfied, c.unsatisfied) {
+			t.Errorf("Closure(%q) unsatisfied = %v; want %v", c.names, unsatisfied, c.unsatisfied)
+		}
+	}
+}
+
+func TestBuildIndicesCandidates(t *testing.T) {
+	rd := testRepoPackages(t, map[string][]*packageData{
+		"current": {
+			{PackageVersion: "libfoo-1_1", ShlibProvides: []string{"libfoo.so.1"}},
+			{PackageVersion: "app-1.0_1", ShlibRequires: []string{"libfoo.so.1"}, RunDepends: []string{"libfoo<2"}},
+		},
+		"nonfree": {
+			{PackageVersion: "libfoo-2_1", ShlibProvides: []string{"libfoo.so.2"}},
+			{PackageVersion: "app-2.0_1", ShlibRequires: []string{"libfoo.so.2"}, RunDepends: []string{"libfoo>=2"}},
+		},
+	})
+
+	if p := rd.Package("libfoo"); p.Repository != "nonfree" {
+		t.Fatalf("preferred libfoo is from %s; want nonfree", p.Repository)
+	}
+
+	pkgvers := func(ps []*packageData) (s []string) {
+		for _, p := range ps {
+			s = append(s, p.Repository+"/"+p.PackageVersion)
+		}
+		return s
+	}
+
+	var revdeps []*packageData
+	for _, d := range rd.RevDeps("libfoo") {
+		revdeps = append(revdeps, d.Package)
+	}
+
+	cases := []struct {
+		what string
+		got  []string
+		want []string
+	}{
+		{"ShlibProviders(libfoo.so.1)", pkgvers(rd.ShlibProviders("libfoo.so.1")), []string{"current/libfoo-1_1"}},
+		{"ShlibProviders(libfoo.so.2)", pkgvers(rd.ShlibProviders("libfoo.so.2")), []string{"nonfree/libfoo-2_1"}},
+		{"ShlibRequirers(libfoo.so.1)", pkgvers(rd.ShlibRequirers("libfoo.so.1")), []string{"current/app-1.0_1"}},
+		{"ShlibRequirers(libfoo.so.2)", pkgvers(rd.ShlibRequirers("libfoo.so.2")), []string{"nonfree/app-2.0_1"}},
+		{"RevDeps(libfoo)", pkgvers(revdeps), []string{"current/app-1.0_1", "nonfree/app-2.0_1"}},
+	}
+
+	for _, c := range cases {
+		if !reflect.DeepEqual(c.got, c.want) {
+			t.Errorf("%s = %v; want %v", c.what, c.got, c.want)
+		}
+	}
+}
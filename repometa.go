@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"howett.net/plist"
+)
+
+var errUnsignedRepo = errors.New("repodata has no signing key")
+
+// repoMeta is the content of a repository's index-meta.plist, which identifies the key used to
+// sign the repository's packages.
+type repoMeta struct {
+	PublicKey     []byte `plist:"public-key"`
+	PublicKeySize int    `plist:"public-key-size"`
+	SignatureBy   string `plist:"signature-by"`
+	SignatureType string `plist:"signature-type"`
+
+	fingerprint string
+}
+
+// repoMetaInfo is the subset of repoMeta served by the API.
+type repoMetaInfo struct {
+	SignatureBy   string `json:"signature_by,omitempty"`
+	SignatureType string `json:"signature_type,omitempty"`
+	PublicKeySize int    `json:"public_key_size,omitempty"`
+	Fingerprint   string `json:"public_key_fingerprint,omitempty"`
+}
+
+func decodeRepoMeta(r io.Reader) (*repoMeta, error) {
+	rs, close, err := readSeeker(r)
+	if err != nil {
+		return nil, err
+	}
+	defer close()
+
+	var meta repoMeta
+	if err = plist.NewDecoder(rs).Decode(&meta); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", repoMetaFile, err)
+	}
+
+	if len(meta.PublicKey) > 0 {
+		if meta.fingerprint, err = keyFingerprint(meta.PublicKey); err != nil {
+			return nil, fmt.Errorf("error decoding %s: %w", repoMetaFile, err)
+		}
+	}
+	return &meta, nil
+}
+
+// keyFingerprint returns the fingerprint of a PEM-encoded RSA public key. As with xbps's
+// xbps_pubkey2fp, this is the MD5 sum of the key in OpenSSH's ssh-rsa wire format (the same
+// fingerprint as ssh-keygen -l -E md5), in colon-separated hex (aa:bb:...).
+func keyFingerprint(pemKey []byte) (string, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return "", errors.New("public key is not PEM-encoded")
+	}
+
+	var key *rsa.PublicKey
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		pub, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return "", err
+		}
+		key = pub
+	default:
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return "", err
+		}
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return "", fmt.Errorf("public key is a %T, not an RSA key", pub)
+		}
+		key = rsaKey
+	}
+
+	var blob bytes.Buffer
+	writeSSHString(&blob, []byte("ssh-rsa"))
+	writeSSHMpint(&blob, big.NewInt(int64(key.E)))
+	writeSSHMpint(&blob, key.N)
+
+	sum := md5.Sum(blob.Bytes())
+	hexes := make([]string, len(sum))
+	for i, b := range sum {
+		hexes[i] = hex.EncodeToString([]byte{b})
+	}
+	return strings.Join(hexes, ":"), nil
+}
+
+// writeSSHString writes p to buf as an SSH string: its length as a big-endian uint32, then p.
+func writeSSHString(buf *bytes.Buffer, p []byte) {
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(p)))
+	buf.Write(size[:])
+	buf.Write(p)
+}
+
+// writeSSHMpint writes a non-negative integer to buf as an SSH mpint. A zero byte is prepended if
+// the high bit is set, so that it isn't read as negative.
+func writeSSHMpint(buf *bytes.Buffer, n *big.Int) {
+	p := n.Bytes()
+	if len(p) > 0 && p[0]&0x80 != 0 {
+		p = append([]byte{0}, p...)
+	}
+	writeSSHString(buf, p)
+}
+
+func (m *repoMeta) Fingerprint() string {
+	if m == nil {
+		return ""
+	}
+	return m.fingerprint
+}
+
+func (m *repoMeta) info() *repoMetaInfo {
+	if m == nil {
+		return nil
+	}
+	return &repoMetaInfo{
+		SignatureBy:   m.SignatureBy,
+		SignatureType: m.SignatureType,
+		PublicKeySize: m.PublicKeySize,
+		Fingerprint:   m.fingerprint,
+	}
+}
+
+// verify returns an error if the repository's key is not in keysDir. Keys are trusted if a file
+// named <fingerprint>.plist exists in keysDir, as in /var/db/xbps/keys.
+func (m *repoMeta) verify(keysDir string) error {
+	fp := m.Fingerprint()
+	if fp == "" {
+		return errUnsignedRepo
+	}
+
+	_, err := os.Stat(filepath.Join(keysDir, fp+".plist"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("repodata signed by %q with untrusted key %s", m.SignatureBy, fp)
+	}
+	return err
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testPublicKey is an RSA public key whose fingerprint was computed by ssh-keygen -l -E md5,
+// which hashes the same ssh-rsa blob as xbps_pubkey2fp.
+const (
+	testPublicKey = `-----BEGIN PUBLIC KEY-----
+MIGfMA0GCSqGSIb3DQEBAQUAA4GNADCBiQKBgQC9fpsz5gRUdVFm9x6z3lGRT//E
+FvCFosyqRSCoufk/qkHMeO2R2Z64TWScO+GM2PuB6KqyR6Z2xaKsIlD+ts3yXDPl
+czkTJsgQ1/eLCm2XbinMI4+oL93magowPLC1CQOe6TLrwhkcN6xX/YOBCmuYVpHp
+l3mf1p8uf1KZ5OapywIDAQAB
+-----END PUBLIC KEY-----
+`
+	testKeyFingerprint = "65:05:cd:a0:61:cb:c6:db:c4:29:70:26:c0:f9:59:a2"
+)
+
+func TestKeyFingerprint(t *testing.T) {
+	fp, err := keyFingerprint([]byte(testPublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp != testKeyFingerprint {
+		t.Errorf("keyFingerprint() = %s; want %s", fp, testKeyFingerprint)
+	}
+
+	if _, err := keyFingerprint([]byte("not a key")); err == nil {
+		t.Error("keyFingerprint() of a non-PEM key = nil error; want an error")
+	}
+}
+
+func TestRepoMetaVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xq-api-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	meta := &repoMeta{PublicKey: []byte(testPublicKey), SignatureBy: "Test <test@example.org>"}
+	if meta.fingerprint, err = keyFingerprint(meta.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := meta.verify(dir); err == nil {
+		t.Error("verify() with no trusted keys = nil; want an error")
+	}
+	if err := (&repoMeta{}).verify(dir); err != errUnsignedRepo {
+		t.Errorf("verify() of unsigned repodata = %v; want %v", err, errUnsignedRepo)
+	}
+
+	keyFile := filepath.Join(dir, testKeyFingerprint+".plist")
+	if err := ioutil.WriteFile(keyFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.verify(dir); err != nil {
+		t.Errorf("verify() with a trusted key = %v; want nil", err)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// snapshotVersion is the version of the snapshot format. It must be incremented whenever the
+// snapshot format or the encoding of packageData changes, so that old snapshots are ignored.
+const snapshotVersion = 1
+
+// snapshotFile is the name of the snapshot in the state directory.
+const snapshotFile = "snapshot.gob"
+
+// snapshotHeader is the first value in a snapshot. It's followed by a snapshotRepo for each
+// repodata file loaded.
+type snapshotHeader struct {
+	Version int
+	Written time.Time
+}
+
+// snapshotRepo is a decoded and prepared repodata file, and the size, modification time, and
+// hash of the file it was decoded from.
+type snapshotRepo struct {
+	Path    string
+	Repo    string
+	Size    int64
+	ModTime time.Time
+	SHA256  []byte
+
+	Meta     *repoMeta
+	Packages []*packageData
+}
+
+// snapshot is a set of repodata files read from a snapshot, by path.
+type snapshot struct {
+	repos map[string]*snapshotRepo
+}
+
+// writeSnapshot writes every repodata file loaded into index to a snapshot at path. The snapshot
+// is written to a temporary file in the same directory, synced, and renamed over path, so path is
+// always a complete snapshot.
+//
+// Only decoded files are written: each arch's indices are still built from them when the
+// snapshot is read.
+func writeSnapshot(path string, index *archIndex) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	enc := gob.NewEncoder(w)
+	if err = enc.Encode(snapshotHeader{Version: snapshotVersion, Written: time.Now().UTC()}); err != nil {
+		return err
+	}
+
+	var sets []*RepoData
+	for _, arch := range index.Index() {
+		sets = append(sets, index.Arch(arch))
+	}
+	staged := make([]string, 0, len(index.staged))
+	for arch := range index.staged {
+		staged = append(staged, arch)
+	}
+	sort.Strings(staged)
+	for _, arch := range staged {
+		sets = append(sets, index.Staged(arch))
+	}
+
+	for _, rd := range sets {
+		for _, src := range rd.Sources() {
+			if src.Path == "" || src.hash == nil {
+				continue
+			}
+			repo := snapshotRepo{
+				Path:     src.Path,
+				Repo:     src.Repository,
+				Size:     src.Size,
+				ModTime:  src.ModTime,
+				SHA256:   src.hash,
+				Meta:     src.meta,
+				Packages: src.packages,
+			}
+			if err = enc.Encode(&repo); err != nil {
+				return fmt.Errorf("error encoding %s: %w", src.Path, err)
+			}
+		}
+	}
+
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// readSnapshot reads the snapshot at path. If the snapshot was written by a different version of
+// xq-api, it returns an error.
+func readSnapshot(path string) (*snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := gob.NewDecoder(bufio.NewReader(f))
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("error decoding snapshot header: %w", err)
+	}
+	if header.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d is not supported (want version %d)",
+			header.Version, snapshotVersion)
+	}
+
+	snap := &snapshot{repos: map[string]*snapshotRepo{}}
+	for {
+		repo := new(snapshotRepo)
+		if err := dec.Decode(repo); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error decoding snapshot: %w", err)
+		}
+		snap.repos[repo.Path] = repo
+	}
+	glog.V(1).Infof("read snapshot of %d repodata files written at %v", len(snap.repos), header.Written)
+	return snap, nil
+}
+
+// lookup returns the decoded repodata for file if its size, modification time, and hash are
+// the same as when the snapshot was written. If keysDir is set, the repodata must still be signed
+// by a trusted key in keysDir. Packages are interned in pool. If file is not in the snapshot or
+// has changed, lookup returns nil.
+func (s *snapshot) lookup(file repodataFile, keysDir string, pool *packagePool) *decodedRepo {
+	if s == nil {
+		return nil
+	}
+	repo := s.repos[file.path]
+	if repo == nil || repo.Repo != file.repo {
+		return nil
+	}
+
+	f, err := os.Open(file.path)
+	if err != nil {
+		glog.V(1).Infof("unable to check %s against snapshot: %v", file.path, err)
+		return nil
+	}
+	defer f.Close()
+
+	// The file is only hashed if its size and modification time haven't changed.
+	var hash []byte
+	size, modTime, err := statRepo(f)
+	if err == nil && size == repo.Size && modTime.Equal(repo.ModTime) {
+		hash, err = hashRepo(f)
+	}
+	if err != nil {
+		glog.V(1).Infof("unable to check %s against snapshot: %v", file.path, err)
+		return nil
+	} else if hash == nil || !bytes.Equal(hash, repo.SHA256) {
+		glog.V(1).Infof("%s changed since snapshot was written", file.path)
+		return nil
+	}
+
+	if repo.Meta != nil && len(repo.Meta.PublicKey) > 0 {
+		if repo.Meta.fingerprint, err = keyFingerprint(repo.Meta.PublicKey); err != nil {
+			return nil
+		}
+	}
+	if keysDir != "" {
+		if err := repo.Meta.verify(keysDir); err != nil {
+			return nil
+		}
+	}
+
+	pkg := make(packageMap, len(repo.Packages))
+	for _, p := range repo.Packages {
+		pkg[p.Name] = pool.intern(p)
+	}
+	return &decodedRepo{
+		repo:    repo.Repo,
+		index:   pkg,
+		meta:    repo.Meta,
+		path:    repo.Path,
+		modTime: repo.ModTime,
+		size:    repo.Size,
+		hash:    repo.SHA256,
+	}
+}
+
+// statRepo returns the size and modification time of an open repodata file.
+func statRepo(f *os.File) (size int64, modTime time.Time, err error) {
+	st, err := f.Stat()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	return st.Size(), st.ModTime().UTC(), nil
+}
+
+// hashRepo returns the SHA-256 hash of an open repodata file. The file is read from its start to
+// its end.
+func hashRepo(f *os.File) ([]byte, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// snapshotPath returns the path to the snapshot in stateDir.
+func snapshotPath(stateDir string) string {
+	return filepath.Join(stateDir, snapshotFile)
+}
+
+// GobEncode encodes t for snapshots.
+func (t timeVal) GobEncode() ([]byte, error) {
+	return time.Time(t).GobEncode()
+}
+
+// GobDecode decodes t from snapshots.
+func (t *timeVal) GobDecode(p []byte) error {
+	return (*time.Time)(t).GobDecode(p)
+}
+
+// GobEncode encodes u for snapshots.
+func (u *urlVal) GobEncode() ([]byte, error) {
+	return u.MarshalText()
+}
+
+// GobDecode decodes u for snapshots.
+func (u *urlVal) GobDecode(p []byte) error {
+	return u.UnmarshalText(p)
+}
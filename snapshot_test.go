@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xq-api-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	repodata := filepath.Join(dir, "repo", "x86_64-repodata")
+	writeTestIndex(t, repodata, map[string]map[string]interface{}{
+		"bash": {
+			"pkgver":       "bash-5.0_1",
+			"architecture": "x86_64",
+			"build-date":   "2019-01-10 09:03 UTC",
+			"homepage":     "http://www.gnu.org/software/bash/bash.html",
+			"run_depends":  []string{"glibc>=2.28_1"},
+			"alternatives": map[string][]string{"sh": {"/usr/bin/sh:bash"}},
+		},
+		"font-util": {"pkgver": "font-util-1.3.2_1", "architecture": "noarch"},
+	})
+	writeTestRepodata(t, filepath.Join(dir, "repo", "x86_64-stagedata"), "bash-5.1_1")
+
+	config := &loadConfig{
+		Paths:    []string{filepath.Join(dir, "repo")},
+		Snapshot: filepath.Join(dir, snapshotFile),
+	}
+	want, err := loadArchIndices(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeSnapshot(config.Snapshot, want); err != nil {
+		t.Fatal(err)
+	}
+
+	snap, err := readSnapshot(config.Snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snap.repos) != 2 {
+		t.Fatalf("snapshot has %d repos; want 2", len(snap.repos))
+	}
+	got, err := loadArchIndices(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []archKey{{arch: "x86_64"}, {arch: "x86_64", staged: true}} {
+		if g, w := got.data(key).ETag(), want.data(key).ETag(); g != w {
+			t.Errorf("%s: ETag = %s; want %s", key, g, w)
+		}
+		for _, p := range want.data(key).Index() {
+			gj, _ := json.Marshal(got.data(key).Package(p.Name))
+			wj, _ := json.Marshal(p)
+			if string(gj) != string(wj) {
+				t.Errorf("%s: %s = %s; want %s", key, p.Name, gj, wj)
+			}
+		}
+	}
+
+	// Changed files are not loaded from the snapshot.
+	file, err := newRepodataFile(repodata, snap.repos[repodata].Repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snap.lookup(file, "", nil) == nil {
+		t.Fatal("unchanged file was not found in snapshot")
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(repodata, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if snap.lookup(file, "", nil) != nil {
+		t.Error("file was loaded from snapshot after its modification time changed")
+	}
+
+	// Nothing but the snapshot is left in the state directory.
+	if matches, _ := filepath.Glob(config.Snapshot + ".*"); len(matches) > 0 {
+		t.Errorf("temporary snapshot files left behind: %q", matches)
+	}
+
+	// Files are only hashed when a snapshot is kept.
+	config.Snapshot = ""
+	unhashed, err := loadArchIndices(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, src := range unhashed.Arch("x86_64").Sources() {
+		if src.hash != nil {
+			t.Errorf("%s was hashed without a snapshot", src.Path)
+		}
+	}
+}
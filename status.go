@@ -0,0 +1,295 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// serverStatus tracks the outcome of reloads and syncs, to report status and readiness.
+type serverStatus struct {
+	mu      sync.RWMutex
+	started time.Time
+	maxAge  time.Duration // Maximum data age before no longer ready (disabled if <= 0)
+
+	lastReload     time.Time
+	reloadDuration time.Duration
+	reloadErr      error
+	lastSuccess    time.Time // Last successful reload
+
+	lastSync time.Time
+	syncErr  error
+
+	// refreshed is the last time data was known to be current: either a successful reload or
+	// a successful sync that found nothing to reload.
+	refreshed time.Time
+
+	// memory is measured when data is set, since reading it stops the world and counting
+	// packages walks all loaded data.
+	memory statusMemory
+}
+
+func newServerStatus() *serverStatus {
+	return &serverStatus{started: time.Now().UTC()}
+}
+
+func (s *serverStatus) reloaded(t time.Time, d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastReload, s.reloadDuration, s.reloadErr = t, d, err
+	if err == nil {
+		s.lastSuccess, s.refreshed = t, t
+	}
+}
+
+func (s *serverStatus) measure(index *archIndex) {
+	mem := newStatusMemory(index)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.memory = mem
+}
+
+func (s *serverStatus) synced(t time.Time, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSync, s.syncErr = t, err
+	if err == nil && !s.lastSuccess.IsZero() && t.After(s.refreshed) {
+		s.refreshed = t
+	}
+}
+
+// ready returns whether data has been loaded and is not older than the maximum data age. If not
+// ready, reason describes why.
+func (s *serverStatus) ready(now time.Time) (ready bool, age time.Duration, reason string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.lastSuccess.IsZero() {
+		return false, 0, "repodata has not been loaded"
+	}
+	age = now.Sub(s.refreshed)
+	if s.maxAge > 0 && age > s.maxAge {
+		return false, age, "repodata is older than " + s.maxAge.String()
+	}
+	return true, age, ""
+}
+
+// SetMaxDataAge sets how old data may be before the server is no longer ready. Data is
+// refreshed by successful reloads and syncs. If maxAge <= 0, data may be any age.
+func (qr *Querier) SetMaxDataAge(maxAge time.Duration) {
+	qr.status.mu.Lock()
+	qr.status.maxAge = maxAge
+	qr.status.mu.Unlock()
+}
+
+// Healthz responds with 200 OK as long as the server is running.
+func (qr *Querier) Healthz(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	w.Header().Set("Cache-Control", "no-cache")
+	if req.Method == "HEAD" {
+		qr.reply(w, http.StatusOK, nil)
+		return
+	}
+
+	response := struct {
+		Data struct {
+			Status string `json:"status"`
+		} `json:"data"`
+	}{}
+	response.Data.Status = "ok"
+	qr.reply(w, http.StatusOK, response)
+}
+
+// Readyz responds with 200 OK if the server has loaded data that is not older than the maximum
+// data age. Otherwise, it responds with 503 Service Unavailable.
+func (qr *Querier) Readyz(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	w.Header().Set("Cache-Control", "no-cache")
+	ready, age, reason := qr.status.ready(time.Now())
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+	if req.Method == "HEAD" {
+		qr.reply(w, code, nil)
+		return
+	}
+
+	type readyStatus struct {
+		Ready   bool    `json:"ready"`
+		DataAge float64 `json:"data_age"`
+		Reason  string  `json:"reason,omitempty"`
+	}
+	response := struct {
+		Data readyStatus `json:"data"`
+	}{
+		Data: readyStatus{Ready: ready, DataAge: age.Seconds(), Reason: reason},
+	}
+	qr.reply(w, code, response)
+}
+
+type statusResult struct {
+	Time     time.Time `json:"time"`
+	Duration *float64  `json:"duration,omitempty"` // Seconds (reloads only)
+	Error    string    `json:"error,omitempty"`
+}
+
+type statusArch struct {
+	Arch           string `json:"arch"`
+	Packages       int    `json:"packages"`
+	StagedPackages int    `json:"staged_packages,omitempty"`
+	Stale          bool   `json:"stale,omitempty"` // Kept from a previous load due to errors
+}
+
+type statusMemory struct {
+	Time      time.Time `json:"time"`       // When memory was measured
+	HeapAlloc uint64    `json:"heap_alloc"` // Bytes
+	HeapInuse uint64    `json:"heap_inuse"` // Bytes
+	Sys       uint64    `json:"sys"`        // Bytes
+	GCCycles  uint32    `json:"gc_cycles"`
+
+	Packages       int       `json:"packages"`        // Packages in all repodata and stage data
+	UniquePackages int       `json:"unique_packages"` // Packages, counting shared packages once
+	Interned       poolStats `json:"interned"`        // Interned by the last load
+}
+
+// newStatusMemory returns memory use by the runtime and loaded packages.
+func newStatusMemory(index *archIndex) statusMemory {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	mem := statusMemory{
+		Time:      time.Now().UTC(),
+		HeapAlloc: ms.HeapAlloc,
+		HeapInuse: ms.HeapInuse,
+		Sys:       ms.Sys,
+		GCCycles:  ms.NumGC,
+	}
+	if index == nil {
+		return mem
+	}
+	mem.Interned = index.pool
+
+	seen := map[*packageData]struct{}{}
+	count := func(rd *RepoData) {
+		if rd == nil {
+			return
+		}
+		for _, candidates := range rd.candidates {
+			for _, p := range candidates {
+				seen[p] = struct{}{}
+				mem.Packages++
+			}
+		}
+	}
+	for _, rd := range index.archs {
+		count(rd)
+	}
+	for _, rd := range index.staged {
+		count(rd)
+	}
+	mem.UniquePackages = len(seen)
+	return mem
+}
+
+type statusFile struct {
+	Path       string    `json:"path"`
+	Arch       string    `json:"arch"`
+	Repository string    `json:"repository"`
+	Staged     bool      `json:"staged,omitempty"`
+	ModTime    time.Time `json:"mod_time"`
+	Size       int64     `json:"size"`
+	Packages   int       `json:"packages"`
+	LoadedAt   time.Time `json:"loaded_at"`
+}
+
+// Status responds with the state of loaded data and the last reload and sync.
+func (qr *Querier) Status(w http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	w.Header().Set("Cache-Control", "no-cache")
+	if req.Method == "HEAD" {
+		qr.reply(w, http.StatusOK, nil)
+		return
+	}
+
+	now := time.Now()
+	ready, age, _ := qr.status.ready(now)
+	index := qr.getData()
+
+	type statusData struct {
+		Ready       bool          `json:"ready"`
+		Started     time.Time     `json:"started"`
+		DataAge     float64       `json:"data_age,omitempty"`
+		LastSuccess *time.Time    `json:"last_success,omitempty"`
+		LastReload  *statusResult `json:"last_reload,omitempty"`
+		LastSync    *statusResult `json:"last_sync,omitempty"`
+		Archs       []statusArch  `json:"archs"`
+		Files       []statusFile  `json:"files"`
+		Errors      []loadError   `json:"errors"`
+		Memory      statusMemory  `json:"memory"`
+	}
+
+	s := qr.status
+	s.mu.RLock()
+	data := statusData{
+		Ready:   ready,
+		Started: s.started,
+		DataAge: age.Seconds(),
+		Archs:   []statusArch{},
+		Files:   []statusFile{},
+		Errors:  index.Errors(),
+		Memory:  s.memory,
+	}
+	if data.Errors == nil {
+		data.Errors = []loadError{}
+	}
+	if !s.lastSuccess.IsZero() {
+		t := s.lastSuccess
+		data.LastSuccess = &t
+	}
+	if !s.lastReload.IsZero() {
+		d := s.reloadDuration.Seconds()
+		data.LastReload = &statusResult{Time: s.lastReload, Duration: &d}
+		if s.reloadErr != nil {
+			data.LastReload.Error = s.reloadErr.Error()
+		}
+	}
+	if !s.lastSync.IsZero() {
+		data.LastSync = &statusResult{Time: s.lastSync}
+		if s.syncErr != nil {
+			data.LastSync.Error = s.syncErr.Error()
+		}
+	}
+	s.mu.RUnlock()
+
+	addFiles := func(arch string, rd *RepoData, staged bool) {
+		for _, src := range rd.Sources() {
+			data.Files = append(data.Files, statusFile{
+				Path:       src.Path,
+				Arch:       arch,
+				Repository: src.Repository,
+				Staged:     staged,
+				ModTime:    src.ModTime,
+				Size:       src.Size,
+				Packages:   src.Packages,
+				LoadedAt:   src.LoadedAt,
+			})
+		}
+	}
+	for _, arch := range index.Archs() {
+		rd, staged := index.Arch(arch), index.Staged(arch)
+		data.Archs = append(data.Archs, statusArch{
+			Arch:           arch,
+			Packages:       len(rd.Index()),
+			StagedPackages: len(staged.Index()),
+			Stale:          index.Kept(arch),
+		})
+		addFiles(arch, rd, false)
+		addFiles(arch, staged, true)
+	}
+
+	response := struct {
+		Data statusData `json:"data"`
+	}{
+		Data: data,
+	}
+	qr.reply(w, http.StatusOK, response)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadyz(t *testing.T) {
+	qr := NewQuerier(1, 1, 1)
+	type readyResponse struct {
+		Data struct {
+			Ready   bool    `json:"ready"`
+			DataAge float64 `json:"data_age"`
+			Reason  string  `json:"reason"`
+		} `json:"data"`
+	}
+	readyz := func() (int, readyResponse) {
+		t.Helper()
+		var response readyResponse
+		w := testQuery(t, qr.Readyz, "/readyz", nil, nil)
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("GET /readyz: unable to decode response: %v", err)
+		}
+		return w.Code, response
+	}
+
+	// Not ready before the first load, even after a failed reload or a sync.
+	qr.status.reloaded(time.Now(), time.Second, errors.New("no repodata found"))
+	qr.status.synced(time.Now(), nil)
+	if code, r := readyz(); code != http.StatusServiceUnavailable || r.Data.Ready || r.Data.Reason != "repodata has not been loaded" {
+		t.Errorf("before first load: status = %d, response = %+v; want 503 and not loaded", code, r.Data)
+	}
+
+	qr.status.reloaded(time.Now(), time.Second, nil)
+	if code, r := readyz(); code != http.StatusOK || !r.Data.Ready || r.Data.Reason != "" {
+		t.Errorf("after load: status = %d, response = %+v; want 200 and ready", code, r.Data)
+	}
+
+	qr.SetMaxDataAge(time.Minute)
+	qr.status.reloaded(time.Now().Add(-2*time.Minute), time.Second, nil)
+	if code, r := readyz(); code != http.StatusServiceUnavailable || r.Data.Ready || r.Data.DataAge < 120 {
+		t.Errorf("with old data: status = %d, response = %+v; want 503 and data_age >= 120", code, r.Data)
+	}
+}
+
+func TestServerStatusMaxAge(t *testing.T) {
+	start := time.Date(2019, 1, 10, 0, 0, 0, 0, time.UTC)
+	s := newServerStatus()
+	s.maxAge = time.Hour
+	s.reloaded(start, time.Second, nil)
+
+	check := func(when string, now time.Time, wantReady bool, wantAge time.Duration) {
+		t.Helper()
+		ready, age, reason := s.ready(now)
+		if ready != wantReady || age != wantAge {
+			t.Errorf("%s: ready = %t, %v (%q); want %t, %v", when, ready, age, reason, wantReady, wantAge)
+		}
+		if !ready && reason != "repodata is older than 1h0m0s" {
+			t.Errorf("%s: reason = %q", when, reason)
+		}
+	}
+
+	check("at max age", start.Add(time.Hour), true, time.Hour)
+	check("past max age", start.Add(time.Hour+time.Second), false, time.Hour+time.Second)
+
+	// Failures don't refresh data, but a successful sync does.
+	s.reloaded(start.Add(30*time.Minute), time.Second, errors.New("failed"))
+	s.synced(start.Add(30*time.Minute), errors.New("failed"))
+	check("after failures", start.Add(time.Hour+time.Second), false, time.Hour+time.Second)
+	s.synced(start.Add(30*time.Minute), nil)
+	check("after sync", start.Add(time.Hour+time.Second), true, 30*time.Minute+time.Second)
+
+	s.maxAge = 0
+	check("without max age", start.Add(24*time.Hour), true, 23*time.Hour+30*time.Minute)
+}
+
+func TestStatusHandler(t *testing.T) {
+	current := testRepoData(t, map[string][]string{
+		"current": {"bash-5.0_1", "curl-7.74.0_1"},
+		"nonfree": {"unrar-6.0.3_1"},
+	})
+	staged := testRepoData(t, map[string][]string{"current": {"curl-7.75.0_1"}})
+	index := &archIndex{
+		archs:  map[string]*RepoData{"x86_64": current},
+		staged: map[string]*RepoData{"x86_64": staged},
+		errors: []loadError{{Path: "i686-repodata", Arch: "i686", Error: "bad repodata"}},
+		kept:   map[archKey]bool{{arch: "x86_64", staged: true}: true},
+	}
+	if err := index.init(); err != nil {
+		t.Fatal(err)
+	}
+	qr := NewQuerier(1, 1, 1)
+	qr.SetData(index)
+
+	loaded := time.Date(2019, 1, 10, 0, 0, 0, 0, time.UTC)
+	qr.status.reloaded(loaded, 2*time.Second, nil)
+	qr.status.reloaded(loaded.Add(time.Minute), time.Second, errors.New("no repodata found"))
+	qr.status.synced(loaded.Add(2*time.Minute), errors.New("mirror unavailable"))
+
+	var response struct {
+		Data struct {
+			Ready       bool         `json:"ready"`
+			LastSuccess *time.Time   `json:"last_success"`
+			LastReload  statusResult `json:"last_reload"`
+			LastSync    statusResult `json:"last_sync"`
+			Archs       []statusArch `json:"archs"`
+			Files       []struct {
+				Arch       string `json:"arch"`
+				Repository string `json:"repository"`
+				Staged     bool   `json:"staged"`
+				Packages   int    `json:"packages"`
+			} `json:"files"`
+			Errors []loadError `json:"errors"`
+		} `json:"data"`
+	}
+	if w := testQuery(t, qr.Status, "/v1/status", nil, &response); w.Code != http.StatusOK {
+		t.Fatalf("GET /v1/status: status = %d; want 200", w.Code)
+	}
+	data := response.Data
+
+	if !data.Ready {
+		t.Error("ready = false; want true")
+	}
+	if data.LastSuccess == nil || !data.LastSuccess.Equal(loaded) {
+		t.Errorf("last_success = %v; want %v", data.LastSuccess, loaded)
+	}
+	if r := data.LastReload; !r.Time.Equal(loaded.Add(time.Minute)) || r.Duration == nil || *r.Duration != 1 || r.Error != "no repodata found" {
+		t.Errorf("last_reload = %+v; want the failed reload", r)
+	}
+	if r := data.LastSync; !r.Time.Equal(loaded.Add(2*time.Minute)) || r.Duration != nil || r.Error != "mirror unavailable" {
+		t.Errorf("last_sync = %+v; want the failed sync", r)
+	}
+	if want := []statusArch{{Arch: "x86_64", Packages: 3, StagedPackages: 1, Stale: true}}; !reflect.DeepEqual(data.Archs, want) {
+		t.Errorf("archs = %+v; want %+v", data.Archs, want)
+	}
+	if len(data.Files) != 3 {
+		t.Errorf("files = %+v; want 3", data.Files)
+	} else if f := data.Files[2]; f.Arch != "x86_64" || f.Repository != "current" || !f.Staged || f.Packages != 1 {
+		t.Errorf("staged file = %+v; want x86_64 current stage data with 1 package", f)
+	}
+	if len(data.Errors) != 1 || data.Errors[0].Error != "bad repodata" {
+		t.Errorf("errors = %+v; want bad repodata", data.Errors)
+	}
+}
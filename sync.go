@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// syncUserAgent is the User-Agent sent when downloading repodata.
+const syncUserAgent = "xq-api (+https://github.com/nilium/xq-api)"
+
+// Syncer downloads <arch>-repodata files from HTTP mirrors into a local directory, similar to
+// xbps-install -S. Each mirror is stored under Dir by its URL path from its last current
+// component on, so a mirror of https://example.org/voidlinux/current/musl is written to
+// Dir/current/musl/<arch>-repodata and is loaded as the musl repository.
+type Syncer struct {
+	Client  *http.Client
+	Dir     string
+	Mirrors []string
+	Archs   []string
+}
+
+// Sync downloads repodata for every mirror and architecture. Repodata that has not changed
+// since it was last downloaded is skipped using conditional requests. It returns true if any
+// repodata was updated.
+//
+// A failure to download one file does not prevent others from being downloaded. If any file
+// fails, the first error encountered is returned.
+func (s *Syncer) Sync(ctx context.Context) (changed bool, err error) {
+	for _, mirror := range s.Mirrors {
+		for _, arch := range s.Archs {
+			updated, ferr := s.syncFile(ctx, mirror, arch)
+			if ferr != nil {
+				glog.Warningf("unable to sync %s repodata from %s: %v", arch, mirror, ferr)
+				if err == nil {
+					err = ferr
+				}
+				continue
+			}
+			changed = changed || updated
+		}
+	}
+	return changed, err
+}
+
+func (s *Syncer) client() *http.Client {
+	if s.Client != nil {
+		return s.Client
+	}
+	return http.DefaultClient
+}
+
+// CheckMirrors returns an error if any mirror URL is invalid or if two mirrors would be written to
+// the same directory. Since mirrors are stored by URL path alone, mirrors with the same path on
+// different hosts or under different prefixes (e.g., https://a/current and https://b/void/current)
+// would overwrite each other's repodata and conditional request state.
+func (s *Syncer) CheckMirrors() error {
+	dirs := make(map[string]string, len(s.Mirrors))
+	for _, mirror := range s.Mirrors {
+		dir, err := s.mirrorDir(mirror)
+		if err != nil {
+			return fmt.Errorf("invalid mirror %q: %w", mirror, err)
+		}
+		if other, ok := dirs[dir]; ok && strings.TrimSuffix(other, "/") != strings.TrimSuffix(mirror, "/") {
+			return fmt.Errorf("mirrors %s and %s would both be synced to %s", other, mirror, dir)
+		}
+		dirs[dir] = mirror
+	}
+	return nil
+}
+
+// mirrorDir returns the local directory that repodata from mirror is written to. Only the part of
+// the mirror's URL path from its last current component on is used, so that a mirror's path
+// prefix (such as /voidlinux in /voidlinux/current/musl) doesn't become part of its repository
+// name. Paths without a current component are used in full.
+func (s *Syncer) mirrorDir(mirror string) (string, error) {
+	u, err := url.Parse(mirror)
+	if err != nil {
+		return "", err
+	}
+	dir := path.Clean("/" + u.Path)
+	if i := strings.LastIndex(dir+"/", "/"+defaultRepository+"/"); i > 0 {
+		dir = dir[i:]
+	}
+	if dir == "/" {
+		dir = defaultRepository
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(dir)), nil
+}
+
+// mirrorPath returns the local path that repodata for arch from mirror is written to.
+func (s *Syncer) mirrorPath(mirror, arch string) (string, error) {
+	dir, err := s.mirrorDir(mirror)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, arch+"-repodata"), nil
+}
+
+func (s *Syncer) syncFile(ctx context.Context, mirror, arch string) (changed bool, err error) {
+	dest, err := s.mirrorPath(mirror, arch)
+	if err != nil {
+		return false, err
+	}
+
+	src := strings.TrimSuffix(mirror, "/") + "/" + arch + "-repodata"
+	req, err := http.NewRequest("GET", src, nil)
+	if err != nil {
+		return false, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", syncUserAgent)
+
+	// Only send conditional headers if the file is still present. The file's mtime is set to
+	// the mirror's Last-Modified time when downloaded.
+	if fi, err := os.Stat(dest); err == nil {
+		req.Header.Set("If-Modified-Since", fi.ModTime().UTC().Format(http.TimeFormat))
+		if etag, err := ioutil.ReadFile(dest + ".etag"); err == nil && len(etag) > 0 {
+			req.Header.Set("If-None-Match", string(etag))
+		}
+	}
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		glog.V(1).Infof("%s not modified", src)
+		return false, nil
+	case http.StatusNotFound:
+		// Not every mirror has every arch (e.g., current/musl has no glibc repodata).
+		glog.V(1).Infof("%s not found; skipping", src)
+		return false, nil
+	default:
+		return false, fmt.Errorf("GET %s: unexpected status %s", src, resp.Status)
+	}
+
+	var mtime time.Time
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		mtime, _ = http.ParseTime(lm)
+	}
+	if err := writeFileAtomic(dest, resp.Body, mtime); err != nil {
+		return false, err
+	}
+
+	etagPath := dest + ".etag"
+	if etag := resp.Header.Get("Etag"); etag != "" {
+		err = writeFileAtomic(etagPath, strings.NewReader(etag), time.Time{})
+	} else if err = os.Remove(etagPath); os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	glog.Infof("synced %s to %s", src, dest)
+	return true, nil
+}
+
+// writeFileAtomic writes the contents of r to a temporary file in the same directory as path
+// and renames it to path once written. If mtime is not zero, the file's access and modification
+// times are set to mtime.
+func writeFileAtomic(path string, r io.Reader, mtime time.Time) (err error) {
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err = io.Copy(tmp, r); err != nil {
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if !mtime.IsZero() {
+		if err = os.Chtimes(tmp.Name(), mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readMirrorConfig reads mirror URLs from an xbps.d(5)-style configuration file. Only
+// repository=<url> lines are used; all other lines are ignored.
+func readMirrorConfig(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mirrors []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i != -1 {
+			line = line[:i]
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq == -1 || strings.TrimSpace(line[:eq]) != "repository" {
+			continue
+		}
+		if mirror := strings.TrimSpace(line[eq+1:]); mirror != "" {
+			mirrors = append(mirrors, mirror)
+		}
+	}
+	return mirrors, scanner.Err()
+}
+
+var errNoSyncDir = errors.New("a sync directory is required to sync repodata from mirrors")
+
+func syncOnInterval(api *Querier, syncer *Syncer, config *loadConfig, interval time.Duration) {
+	for range time.Tick(interval) {
+		changed, err := syncer.Sync(context.Background())
+		if err != nil {
+			glog.Warningf("Error syncing repository data: %v", err)
+		}
+		api.status.synced(time.Now().UTC(), err)
+		if !changed {
+			continue
+		}
+		if err := reloadRepoData(api, config); err != nil {
+			glog.Warningf("Error reloading repository data after sync: %v", err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncerConditional(t *testing.T) {
+	const (
+		body = "repodata"
+		etag = `"v1"`
+	)
+	modified := time.Date(2019, 1, 10, 9, 3, 0, 0, time.UTC)
+
+	requests := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests[req.URL.Path]++
+		if req.URL.Path != "/current/musl/x86_64-musl-repodata" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Etag", etag)
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		if req.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "xq-api-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := &Syncer{
+		Client:  srv.Client(),
+		Dir:     dir,
+		Mirrors: []string{srv.URL + "/current/musl/"},
+		Archs:   []string{"x86_64", "x86_64-musl"},
+	}
+
+	changed, err := syncer.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if !changed {
+		t.Fatal("Sync() changed = false; want true")
+	}
+
+	dest := filepath.Join(dir, "current", "musl", "x86_64-musl-repodata")
+	if p, err := ioutil.ReadFile(dest); err != nil {
+		t.Fatal(err)
+	} else if string(p) != body {
+		t.Errorf("synced file = %q; want %q", p, body)
+	}
+	if fi, err := os.Stat(dest); err != nil {
+		t.Fatal(err)
+	} else if !fi.ModTime().Equal(modified) {
+		t.Errorf("synced file mtime = %v; want %v", fi.ModTime(), modified)
+	}
+	if repo := repositoryFromFileSearchRoot(dir, dest); repo != "musl" {
+		t.Errorf("repository = %q; want %q", repo, "musl")
+	}
+
+	changed, err = syncer.Sync(context.Background())
+	if err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if changed {
+		t.Error("second Sync() changed = true; want false")
+	}
+
+	if n := requests["/current/musl/x86_64-musl-repodata"]; n != 2 {
+		t.Errorf("repodata requests = %d; want 2", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "current", "musl", "x86_64-repodata")); !os.IsNotExist(err) {
+		t.Errorf("missing repodata was written: %v", err)
+	}
+}
+
+func TestSyncerPrefixedMirrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(req.URL.Path))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "xq-api-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	syncer := &Syncer{
+		Client: srv.Client(),
+		Dir:    dir,
+		Mirrors: []string{
+			srv.URL + "/voidlinux/current",
+			srv.URL + "/voidlinux/current/musl",
+			srv.URL + "/pub/voidlinux/current/nonfree/",
+		},
+		Archs: []string{"x86_64"},
+	}
+	if err := syncer.CheckMirrors(); err != nil {
+		t.Fatalf("CheckMirrors() = %v; want nil", err)
+	}
+	if _, err := syncer.Sync(context.Background()); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+
+	cases := []struct {
+		path string
+		src  string
+		repo string
+	}{
+		{"current/x86_64-repodata", "/voidlinux/current/x86_64-repodata", "current"},
+		{"current/musl/x86_64-repodata", "/voidlinux/current/musl/x86_64-repodata", "musl"},
+		{"current/nonfree/x86_64-repodata", "/pub/voidlinux/current/nonfree/x86_64-repodata", "nonfree"},
+	}
+	for _, c := range cases {
+		dest := filepath.Join(dir, filepath.FromSlash(c.path))
+		if p, err := ioutil.ReadFile(dest); err != nil {
+			t.Errorf("%s: %v", c.path, err)
+		} else if string(p) != c.src {
+			t.Errorf("%s was synced from %s; want %s", c.path, p, c.src)
+		}
+		if repo := repositoryFromFileSearchRoot(dir, dest); repo != c.repo {
+			t.Errorf("%s: repository = %q; want %q", c.path, repo, c.repo)
+		}
+	}
+}
+
+func TestSyncerCheckMirrors(t *testing.T) {
+	s := &Syncer{Dir: "sync", Mirrors: []string{
+		"https://a.example.org/current",
+		"https://a.example.org/current/",
+		"https://b.example.org/current/musl",
+	}}
+	if err := s.CheckMirrors(); err != nil {
+		t.Fatalf("CheckMirrors() = %v; want nil", err)
+	}
+
+	s.Mirrors = append(s.Mirrors, "https://c.example.org/current")
+	if err := s.CheckMirrors(); err == nil {
+		t.Fatal("CheckMirrors() = nil; want an error for mirrors with the same path")
+	}
+
+	s.Mirrors = []string{"https://a.example.org/current/musl", "https://b.example.org/voidlinux/current/musl"}
+	if err := s.CheckMirrors(); err == nil {
+		t.Fatal("CheckMirrors() = nil; want an error for mirrors with the same path after their prefix")
+	}
+}
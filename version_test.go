@@ -78,3 +78,38 @@ func TestParseVersionedName(t *testing.T) {
 		}
 	}
 }
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"1.0_1", "1.0_1", 0},
+		{"1.0", "1.0_0", 0},
+		{"1.0_1", "1.0_2", -1},
+		{"1.0_10", "1.0_9", 1},
+		{"1.0_1", "1.0.1_1", -1},
+		{"1.10_1", "1.9_1", 1},
+		{"1.0alpha1_1", "1.0beta1_1", -1},
+		{"1.0beta2_1", "1.0rc1_1", -1},
+		{"1.0rc1_1", "1.0_1", -1},
+		{"1.0pre1_1", "1.0rc1_1", 0},
+		{"1.0RC1_1", "1.0rc1_1", 0},
+		{"1.0_1", "1.0pl1_1", -1},
+		{"1.0a_1", "1.0_1", 1},
+		{"1.0a_1", "1.0b_1", -1},
+		{"3.99u4b5s7_2", "3.99u4b5s8_1", -1},
+		{"0.5.1+rc1_1", "0.5.1_1", -1},
+		{"5:5.16.1_2", "5.17_1", 1},
+		{"5:5.16.1_2", "5:5.16.2_1", -1},
+	}
+
+	for _, c := range cases {
+		if got := CompareVersions(c.a, c.b); got != c.want {
+			t.Errorf("CompareVersions(%q, %q) = %d; want %d", c.a, c.b, got, c.want)
+		}
+		if got := CompareVersions(c.b, c.a); got != -c.want {
+			t.Errorf("CompareVersions(%q, %q) = %d; want %d", c.b, c.a, got, -c.want)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/golang/glog"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// watchDirMask is the set of inotify events watched for in directories.
+	watchDirMask = unix.IN_CLOSE_WRITE | unix.IN_MOVED_TO | unix.IN_MOVED_FROM |
+		unix.IN_CREATE | unix.IN_DELETE | unix.IN_DELETE_SELF | unix.IN_ONLYDIR
+)
+
+// repodataWatcher watches repodata paths for changes using inotify. Directories are watched
+// recursively, including directories created after the watcher starts. Files are watched by
+// watching their parent directories.
+type repodataWatcher struct {
+	fd   int
+	file *os.File // fd, for reads that are interrupted by Close
+
+	mu    sync.Mutex
+	dirs  map[int]*watchedDir // Watched directories by watch descriptor
+	files map[string]bool     // Repodata files watched outside of recursively watched directories
+}
+
+type watchedDir struct {
+	path      string
+	recursive bool // Whether all files and subdirectories are watched
+}
+
+// newRepodataWatcher creates a watcher for the repodata files and directories in paths. Paths
+// that don't exist are not watched.
+func newRepodataWatcher(paths []string) (*repodataWatcher, error) {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &repodataWatcher{
+		fd: fd,
+		// A non-blocking file uses the runtime poller, so Close interrupts a pending Read.
+		file:  os.NewFile(uintptr(fd), "inotify"),
+		dirs:  map[int]*watchedDir{},
+		files: map[string]bool{},
+	}
+	for _, path := range paths {
+		path, err := filepath.Abs(path)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			glog.Warningf("unable to watch %s: %v", path, err)
+			continue
+		}
+		if fi.IsDir() {
+			_, err = w.addDirs(path)
+		} else {
+			w.files[path] = true
+			err = w.add(filepath.Dir(path), false)
+		}
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// Close stops watching for changes.
+func (w *repodataWatcher) Close() error {
+	return w.file.Close()
+}
+
+// add watches a directory. If recursive, all repodata files in the directory are watched and
+// new subdirectories are watched as they're created.
+func (w *repodataWatcher) add(dir string, recursive bool) error {
+	wd, err := unix.InotifyAddWatch(w.fd, dir, watchDirMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if wdir := w.dirs[wd]; wdir != nil {
+		wdir.recursive = wdir.recursive || recursive
+		return nil
+	}
+	w.dirs[wd] = &watchedDir{path: dir, recursive: recursive}
+	glog.V(2).Infof("watching %s for repodata changes", dir)
+	return nil
+}
+
+// addDirs recursively watches root and all directories under it. It returns the archs of any
+// repodata files found while walking root.
+func (w *repodataWatcher) addDirs(root string) (archs []string, err error) {
+	err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			glog.Warningf("unable to watch %s: %v", path, err)
+			return nil
+		}
+		if fi.IsDir() {
+			return w.add(path, true)
+		}
+		if arch, _, ok := splitRepodataPath(path); ok {
+			archs = append(archs, arch)
+		}
+		return nil
+	})
+	return archs, err
+}
+
+// Watch reads changes until the watcher is closed. Changes are collected until no change has
+// been seen for delay, after which reload is called with the archs whose repodata or stage data
+// changed. If archs is empty, events were lost and everything should be reloaded.
+func (w *repodataWatcher) Watch(delay time.Duration, reload func(archs []string)) {
+	changes := make(chan []string)
+	go w.read(changes)
+
+	var (
+		pending = map[string]bool{}
+		all     bool // Events were lost
+		timer   = time.NewTimer(delay)
+	)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case archs, ok := <-changes:
+			if !ok {
+				return
+			}
+			if archs == nil {
+				all = true
+			}
+			for _, arch := range archs {
+				pending[arch] = true
+			}
+			// Restart the timer so that a burst of changes causes a single reload.
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(delay)
+
+		case <-timer.C:
+			var archs []string
+			if !all {
+				for arch := range pending {
+					archs = append(archs, arch)
+				}
+				sort.Strings(archs)
+			}
+			pending, all = map[string]bool{}, false
+			reload(archs)
+		}
+	}
+}
+
+// read reads inotify events and sends the archs of changed repodata files to changes. If events
+// were lost, it sends a nil slice. changes is closed when the watcher is closed.
+func (w *repodataWatcher) read(changes chan<- []string) {
+	defer close(changes)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				glog.Errorf("error reading repodata changes: %v", err)
+			}
+			return
+		}
+
+		var archs []string
+		lost := false
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameAt := off + unix.SizeofInotifyEvent
+			off = nameAt + int(ev.Len)
+			if off > n {
+				break
+			}
+			name := strings.TrimRight(string(buf[nameAt:off]), "\x00")
+
+			if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+				glog.Warning("inotify queue overflowed; reloading all repodata")
+				lost = true
+				continue
+			}
+			changed, err := w.handle(int(ev.Wd), ev.Mask, name)
+			if err != nil {
+				glog.Warningf("error watching for repodata changes: %v", err)
+			}
+			archs = append(archs, changed...)
+		}
+
+		if lost {
+			changes <- nil
+		} else if len(archs) > 0 {
+			changes <- archs
+		}
+	}
+}
+
+// handle handles a single inotify event and returns the archs of repodata files it changed.
+func (w *repodataWatcher) handle(wd int, mask uint32, name string) (archs []string, err error) {
+	w.mu.Lock()
+	dir := w.dirs[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	w.mu.Unlock()
+	if dir == nil || name == "" {
+		return nil, nil
+	}
+
+	path := filepath.Join(dir.path, name)
+	if mask&unix.IN_ISDIR != 0 {
+		// Watch new directories and pick up any repodata already written to them.
+		if dir.recursive && mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+			return w.addDirs(path)
+		}
+		return nil, nil
+	}
+
+	if !dir.recursive && !w.files[path] {
+		return nil, nil
+	}
+	arch, _, ok := splitRepodataPath(path)
+	if !ok || mask&unix.IN_CREATE != 0 {
+		// Created files are reloaded once they've been written (IN_CLOSE_WRITE).
+		return nil, nil
+	}
+	glog.V(1).Infof("repodata changed: %s", path)
+	return []string{arch}, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRepodataWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xq-api-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTestRepodata(t, filepath.Join(dir, "x86_64-repodata"), "bash-5.0_1")
+
+	w, err := newRepodataWatcher([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloads := make(chan []string, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Watch(100*time.Millisecond, func(archs []string) { reloads <- archs })
+	}()
+
+	// Changes to existing files and files in new directories are reloaded together.
+	writeTestRepodata(t, filepath.Join(dir, "x86_64-repodata"), "bash-5.0_2")
+	writeTestRepodata(t, filepath.Join(dir, "nonfree", "aarch64-repodata"), "unrar-6.0.3_1")
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case archs := <-reloads:
+		if want := []string{"aarch64", "x86_64"}; !reflect.DeepEqual(archs, want) {
+			t.Errorf("reloaded %q; want %q", archs, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for reload")
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not return after Close")
+	}
+}
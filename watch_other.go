@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// repodataWatcher is only supported on Linux.
+type repodataWatcher struct{}
+
+func newRepodataWatcher(paths []string) (*repodataWatcher, error) {
+	return nil, errors.New("watching repodata for changes is only supported on Linux")
+}
+
+func (w *repodataWatcher) Close() error { return nil }
+
+func (w *repodataWatcher) Watch(delay time.Duration, reload func(archs []string)) {}
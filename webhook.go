@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// webhookSignatureHeader is the header containing the HMAC-SHA256 of a webhook's timestamp
+	// and body, as sha256=<hex>. See signWebhook.
+	webhookSignatureHeader = "X-Xqapi-Signature"
+	webhookTimestampHeader = "X-Xqapi-Timestamp"
+	webhookDeliveryHeader  = "X-Xqapi-Delivery"
+	webhookEventHeader     = "X-Xqapi-Event"
+
+	// webhookLogFile is the file, under the state directory, that deliveries are logged to.
+	webhookLogFile = "webhooks.log"
+
+	// webhookLogSlack is the number of records the delivery log may grow by, beyond twice the
+	// number needed to resume unfinished deliveries, before it's compacted.
+	webhookLogSlack = 256
+
+	// webhookQueueSize is the number of payloads that may be waiting for delivery to a
+	// single URL. Payloads are dropped if a URL's queue is full.
+	webhookQueueSize = 64
+
+	webhookMaxBackoff = 10 * time.Minute
+)
+
+// webhookPayload is the body of a webhook sent after a reload that changed packages.
+type webhookPayload struct {
+	ID    string        `json:"id"`
+	Event string        `json:"event"`
+	Time  time.Time     `json:"time"`
+	Archs []webhookArch `json:"archs"`
+}
+
+// webhookArch is the set of package changes for a single arch.
+type webhookArch struct {
+	Arch    string          `json:"arch"`
+	Changes []packageChange `json:"changes"`
+}
+
+// webhookDelivery is an attempt to deliver a payload to a URL. Every attempt is written to the
+// delivery log, after a record with attempt 0 and the payload for when the payload is queued.
+// When the log is compacted, a delivery's records are replaced by its queued record, with the
+// payload, carrying the number of its last attempt.
+type webhookDelivery struct {
+	Time     time.Time       `json:"t"`
+	ID       string          `json:"id"`
+	URL      string          `json:"url"`
+	Attempt  int             `json:"attempt"`
+	Payload  json.RawMessage `json:"payload,omitempty"` // Queued and compacted records only
+	Status   int             `json:"status,omitempty"`
+	Error    string          `json:"error,omitempty"`
+	Done     bool            `json:"done"` // True if no further attempts will be made
+	Duration float64         `json:"duration,omitempty"`
+}
+
+type webhookKey struct{ id, url string }
+
+type webhookJob struct {
+	id       string
+	body     []byte
+	attempts int // Attempts already made, if resumed from the delivery log
+}
+
+// Webhooks POSTs a JSON payload of package changes to each of its URLs when repodata changes.
+// Each URL has its own queue, so payloads are delivered to a URL in order and a slow or failing
+// URL does not delay others. Failed deliveries are retried with exponential backoff.
+type Webhooks struct {
+	Client      *http.Client
+	URLs        []string
+	Secret      []byte        // Payloads are signed with HMAC-SHA256 using Secret
+	MaxAttempts int           // Attempts per delivery (at least 1)
+	Backoff     time.Duration // Delay before the first retry, doubled for each retry after it
+
+	once    sync.Once
+	queues  map[string]chan webhookJob
+	pending map[string][]webhookJob // Unfinished deliveries from the log, by URL
+
+	logMu      sync.Mutex
+	log        *os.File
+	logPath    string
+	logN       int                             // Records in the log
+	unfinished map[webhookKey]*webhookDelivery // Compacted records of unfinished deliveries
+	order      []webhookKey                    // Deliveries in the order they were queued
+}
+
+// OpenLog opens the delivery log under stateDir and resumes any deliveries in it that were not
+// finished. The log is rewritten with only those deliveries when opened, and again whenever it
+// grows too large. If no log is opened, deliveries are only logged to glog and are lost on exit.
+func (wh *Webhooks) OpenLog(stateDir string) error {
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(stateDir, webhookLogFile)
+	deliveries, err := replayDeliveries(path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	configured := map[string]bool{}
+	for _, url := range wh.URLs {
+		configured[url] = true
+	}
+
+	wh.logMu.Lock()
+	defer wh.logMu.Unlock()
+	wh.logPath = path
+	wh.unfinished = map[webhookKey]*webhookDelivery{}
+	wh.order = nil
+	wh.pending = map[string][]webhookJob{}
+	for _, d := range deliveries {
+		if !configured[d.URL] {
+			glog.Warningf("dropping webhook %s to %s: URL is no longer configured", d.ID, d.URL)
+			continue
+		}
+		glog.Infof("resuming webhook %s to %s after %d attempts", d.ID, d.URL, d.Attempt)
+		k := webhookKey{d.ID, d.URL}
+		wh.unfinished[k] = d
+		wh.order = append(wh.order, k)
+		wh.pending[d.URL] = append(wh.pending[d.URL], webhookJob{id: d.ID, body: d.Payload, attempts: d.Attempt})
+	}
+	if err := wh.compactLog(); err != nil {
+		return fmt.Errorf("error compacting %s: %w", path, err)
+	}
+	if len(wh.pending) > 0 {
+		wh.once.Do(wh.start)
+	}
+	return nil
+}
+
+// replayDeliveries returns the last record of each delivery in the log at path that is not done,
+// in the order they were queued. A missing log has no deliveries. A partial last line is dropped
+// when the log is compacted.
+func replayDeliveries(path string) ([]*webhookDelivery, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		order   []webhookKey
+		pending = map[webhookKey]*webhookDelivery{}
+		r       = bufio.NewReader(f)
+	)
+	for line := 1; ; line++ {
+		p, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(p) > 0 {
+				glog.Warningf("%s:%d: dropping partial webhook delivery record", path, line)
+			}
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		var d webhookDelivery
+		if err := json.Unmarshal(p, &d); err != nil {
+			glog.Warningf("%s:%d: skipping invalid webhook delivery record: %v", path, line, err)
+			continue
+		}
+		k := webhookKey{d.ID, d.URL}
+		switch q := pending[k]; {
+		case d.Done:
+			delete(pending, k)
+		case len(d.Payload) > 0:
+			order = append(order, k)
+			pending[k] = &d
+		case q != nil:
+			q.Attempt = d.Attempt
+		}
+	}
+
+	var deliveries []*webhookDelivery
+	for _, k := range order {
+		if d := pending[k]; d != nil {
+			deliveries = append(deliveries, d)
+			delete(pending, k)
+		}
+	}
+	return deliveries, nil
+}
+
+// compactLog rewrites the delivery log with one record for each unfinished delivery and reopens
+// it for appending. logMu must be held.
+func (wh *Webhooks) compactLog() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(wh.logPath), webhookLogFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	var order []webhookKey
+	w := bufio.NewWriter(tmp)
+	enc := json.NewEncoder(w)
+	for _, k := range wh.order {
+		d := wh.unfinished[k]
+		if d == nil {
+			continue
+		}
+		order = append(order, k)
+		if err := enc.Encode(d); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), wh.logPath); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(wh.logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if wh.log != nil {
+		wh.log.Close()
+	}
+	wh.log, wh.logN, wh.order = f, len(order), order
+	return nil
+}
+
+func (wh *Webhooks) start() {
+	wh.queues = make(map[string]chan webhookJob, len(wh.URLs))
+	for _, url := range wh.URLs {
+		if _, ok := wh.queues[url]; ok {
+			continue
+		}
+		q := make(chan webhookJob, webhookQueueSize)
+		wh.queues[url] = q
+		go wh.run(url, wh.pending[url], q)
+	}
+	wh.pending = nil
+}
+
+// Notify queues a payload of changes, by arch, for delivery to every URL. It does not block.
+func (wh *Webhooks) Notify(t time.Time, changes map[string][]packageChange) {
+	if wh == nil || len(wh.URLs) == 0 || len(changes) == 0 {
+		return
+	}
+	wh.once.Do(wh.start)
+
+	id, err := newDeliveryID()
+	if err != nil {
+		glog.Warningf("unable to create webhook delivery id: %v", err)
+		return
+	}
+
+	payload := webhookPayload{ID: id, Event: "changes", Time: t}
+	for arch, archChanges := range changes {
+		payload.Archs = append(payload.Archs, webhookArch{Arch: arch, Changes: archChanges})
+	}
+	sort.Slice(payload.Archs, func(i, j int) bool { return payload.Archs[i].Arch < payload.Archs[j].Arch })
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		glog.Warningf("unable to encode webhook payload: %v", err)
+		return
+	}
+
+	for url, q := range wh.queues {
+		// The payload is logged before it's queued so that it's never logged after an attempt.
+		wh.record(webhookDelivery{Time: time.Now().UTC(), ID: id, URL: url, Payload: body})
+		select {
+		case q <- webhookJob{id: id, body: body}:
+		default:
+			glog.Warningf("webhook queue for %s is full; dropping delivery %s", url, id)
+			wh.record(webhookDelivery{Time: time.Now().UTC(), ID: id, URL: url, Error: "queue full", Done: true})
+		}
+	}
+}
+
+// run delivers jobs resumed from the delivery log, then jobs from q.
+func (wh *Webhooks) run(url string, resumed []webhookJob, q <-chan webhookJob) {
+	for _, job := range resumed {
+		wh.deliver(url, job)
+	}
+	for job := range q {
+		wh.deliver(url, job)
+	}
+}
+
+// deliver sends a job to url until it succeeds or runs out of attempts.
+func (wh *Webhooks) deliver(url string, job webhookJob) {
+	attempts := wh.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := wh.Backoff
+
+	// Resumed deliveries continue with the backoff they would have had.
+	for i := 0; i < job.attempts; i++ {
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+
+	for attempt := job.attempts + 1; ; attempt++ {
+		start := time.Now()
+		status, err := wh.post(url, job)
+		d := webhookDelivery{
+			Time:     start.UTC(),
+			ID:       job.id,
+			URL:      url,
+			Attempt:  attempt,
+			Status:   status,
+			Duration: time.Since(start).Seconds(),
+		}
+		if err != nil {
+			d.Error = err.Error()
+		}
+		d.Done = err == nil || attempt >= attempts
+		wh.record(d)
+
+		if err == nil {
+			glog.V(1).Infof("delivered webhook %s to %s", job.id, url)
+			return
+		} else if d.Done {
+			glog.Warningf("giving up on webhook %s to %s after %d attempts: %v", job.id, url, attempt, err)
+			return
+		}
+
+		glog.Warningf("webhook %s to %s failed (attempt %d); retrying in %v: %v", job.id, url, attempt, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > webhookMaxBackoff {
+			backoff = webhookMaxBackoff
+		}
+	}
+}
+
+func (wh *Webhooks) post(url string, job webhookJob) (status int, err error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", syncUserAgent)
+	req.Header.Set(webhookEventHeader, "changes")
+	req.Header.Set(webhookDeliveryHeader, job.id)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(webhookTimestampHeader, ts)
+	req.Header.Set(webhookSignatureHeader, signWebhook(wh.Secret, ts, job.body))
+
+	client := wh.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// record writes a delivery attempt to the delivery log, if open, compacting the log if it's grown
+// too large.
+func (wh *Webhooks) record(d webhookDelivery) {
+	wh.logMu.Lock()
+	defer wh.logMu.Unlock()
+	if wh.log == nil {
+		return
+	}
+
+	k := webhookKey{d.ID, d.URL}
+	switch q := wh.unfinished[k]; {
+	case d.Done:
+		delete(wh.unfinished, k)
+	case len(d.Payload) > 0:
+		queued := d
+		wh.unfinished[k] = &queued
+		wh.order = append(wh.order, k)
+	case q != nil:
+		q.Attempt = d.Attempt
+	}
+
+	if wh.logN >= 2*len(wh.unfinished)+webhookLogSlack {
+		if err := wh.compactLog(); err != nil {
+			glog.Warningf("unable to compact webhook delivery log: %v", err)
+		} else {
+			return
+		}
+	}
+
+	p, err := json.Marshal(d)
+	if err != nil {
+		return
+	}
+	if _, err := wh.log.Write(append(p, '\n')); err != nil {
+		glog.Warningf("unable to write webhook delivery log: %v", err)
+		return
+	}
+	wh.logN++
+}
+
+// Close closes the delivery log. Queued deliveries are not waited for, and are resumed when the
+// log is next opened.
+func (wh *Webhooks) Close() error {
+	wh.logMu.Lock()
+	defer wh.logMu.Unlock()
+	if wh.log == nil {
+		return nil
+	}
+	err := wh.log.Close()
+	wh.log = nil
+	return err
+}
+
+// signWebhook returns the signature header value for a webhook body sent at timestamp, in Unix
+// seconds. The timestamp is signed along with the body (as "<timestamp>.<body>") so that a
+// receiver can reject old requests that are replayed to it.
+func signWebhook(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func newDeliveryID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id[:]), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhooksRetry(t *testing.T) {
+	secret := []byte("hunter2")
+	type delivery struct {
+		payload webhookPayload
+		sigOK   bool
+	}
+	received := make(chan delivery, 1)
+	attempts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Fail the first attempt.
+		if attempts++; attempts == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("error reading body: %v", err)
+		}
+		var d delivery
+		if err := json.Unmarshal(body, &d.payload); err != nil {
+			t.Errorf("error decoding payload: %v", err)
+		}
+		ts := req.Header.Get(webhookTimestampHeader)
+		d.sigOK = ts != "" && req.Header.Get(webhookSignatureHeader) == signWebhook(secret, ts, body) &&
+			req.Header.Get(webhookDeliveryHeader) == d.payload.ID
+		received <- d
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "xq-api-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hooks := &Webhooks{
+		Client:      srv.Client(),
+		URLs:        []string{srv.URL},
+		Secret:      secret,
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+	}
+	if err := hooks.OpenLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer hooks.Close()
+
+	changes := map[string][]packageChange{
+		"x86_64": {{ID: 1, Kind: changeUpdated, Name: "gcc", Repository: "current", Version: "10.2.1pre1", Revision: 3}},
+	}
+	hooks.Notify(time.Now(), changes)
+
+	var d delivery
+	select {
+	case d = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for webhook")
+	}
+	if !d.sigOK {
+		t.Error("webhook signature or delivery id does not match")
+	}
+	if len(d.payload.Archs) != 1 || d.payload.Archs[0].Arch != "x86_64" ||
+		len(d.payload.Archs[0].Changes) != 1 || d.payload.Archs[0].Changes[0].Name != "gcc" {
+		t.Errorf("unexpected payload: %+v", d.payload)
+	}
+
+	// The delivery log is written after the response, so wait for the second attempt to be
+	// logged.
+	var logged []webhookDelivery
+	for deadline := time.Now().Add(5 * time.Second); len(logged) < 3 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		logged = readDeliveryLog(t, filepath.Join(dir, webhookLogFile))
+	}
+	if len(logged) != 3 {
+		t.Fatalf("logged %d delivery records; want 3", len(logged))
+	}
+	if d := logged[0]; d.Attempt != 0 || len(d.Payload) == 0 || d.Done {
+		t.Errorf("unexpected queued record: %+v", d)
+	}
+	if d := logged[1]; d.Attempt != 1 || d.Status != http.StatusServiceUnavailable || d.Done {
+		t.Errorf("unexpected first attempt: %+v", d)
+	}
+	if d := logged[2]; d.Attempt != 2 || d.Status != http.StatusOK || !d.Done || d.Error != "" {
+		t.Errorf("unexpected second attempt: %+v", d)
+	}
+}
+
+func TestWebhooksResume(t *testing.T) {
+	received := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Get(webhookDeliveryHeader)
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "xq-api-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A log with one finished delivery, one that failed once, and a partial last line.
+	payload := `{"id":"%s","event":"changes","time":"2019-01-11T19:03:00Z","archs":[]}`
+	log := strings.Join([]string{
+		`{"t":"2019-01-11T19:03:00Z","id":"a","url":"` + srv.URL + `","attempt":0,"payload":` + fmt.Sprintf(payload, "a") + `,"done":false}`,
+		`{"t":"2019-01-11T19:03:00Z","id":"a","url":"` + srv.URL + `","attempt":1,"status":200,"done":true}`,
+		`{"t":"2019-01-11T19:04:00Z","id":"b","url":"` + srv.URL + `","attempt":0,"payload":` + fmt.Sprintf(payload, "b") + `,"done":false}`,
+		`{"t":"2019-01-11T19:04:00Z","id":"b","url":"` + srv.URL + `","attempt":1,"status":503,"done":false}`,
+		`{"t":"2019-01-11T19:04:30Z","id":"b","url"`,
+	}, "\n")
+	if err := ioutil.WriteFile(filepath.Join(dir, webhookLogFile), []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := &Webhooks{
+		Client:      srv.Client(),
+		URLs:        []string{srv.URL},
+		Secret:      []byte("hunter2"),
+		MaxAttempts: 3,
+		Backoff:     time.Millisecond,
+	}
+	if err := hooks.OpenLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer hooks.Close()
+
+	select {
+	case id := <-received:
+		if id != "b" {
+			t.Errorf("resumed delivery %q; want b", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for resumed webhook")
+	}
+
+	// The log is compacted to the unfinished delivery when opened, followed by the resumed attempt.
+	var logged []webhookDelivery
+	for deadline := time.Now().Add(5 * time.Second); len(logged) < 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+		logged = readDeliveryLog(t, filepath.Join(dir, webhookLogFile))
+	}
+	if len(logged) != 2 {
+		t.Fatalf("logged %d delivery records; want 2", len(logged))
+	}
+	if d := logged[0]; d.ID != "b" || d.Attempt != 1 || len(d.Payload) == 0 || d.Done {
+		t.Errorf("unexpected compacted record: %+v", d)
+	}
+	if d := logged[1]; d.ID != "b" || d.Attempt != 2 || !d.Done {
+		t.Errorf("unexpected resumed attempt: %+v", d)
+	}
+	select {
+	case id := <-received:
+		t.Errorf("unexpected delivery %q", id)
+	default:
+	}
+}
+
+func TestWebhooksLogCompacted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xq-api-webhook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// No URLs are configured, so nothing is delivered and records are only logged.
+	hooks := &Webhooks{}
+	if err := hooks.OpenLog(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer hooks.Close()
+
+	payload := json.RawMessage(`{}`)
+	hooks.record(webhookDelivery{ID: "pending", URL: "http://example.org", Payload: payload})
+	hooks.record(webhookDelivery{ID: "pending", URL: "http://example.org", Attempt: 1, Status: 503})
+	for i := 0; i < 4*webhookLogSlack; i++ {
+		id := fmt.Sprint(i)
+		hooks.record(webhookDelivery{ID: id, URL: "http://example.org", Payload: payload})
+		hooks.record(webhookDelivery{ID: id, URL: "http://example.org", Attempt: 1, Status: 200, Done: true})
+	}
+
+	path := filepath.Join(dir, webhookLogFile)
+	if n := len(readDeliveryLog(t, path)); n > webhookLogSlack+2 {
+		t.Errorf("log has %d records; want at most %d", n, webhookLogSlack+2)
+	}
+	deliveries, err := replayDeliveries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 {
+		t.Fatalf("replayed %d deliveries; want 1", len(deliveries))
+	}
+	if d := deliveries[0]; d.ID != "pending" || d.Attempt != 1 || len(d.Payload) == 0 {
+		t.Errorf("unexpected replayed delivery: %+v", d)
+	}
+}
+
+func readDeliveryLog(t *testing.T, path string) []webhookDelivery {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var deliveries []webhookDelivery
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var d webhookDelivery
+		if err := json.Unmarshal(scanner.Bytes(), &d); err != nil {
+			// Partially written
+			break
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries
+}